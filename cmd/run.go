@@ -23,11 +23,24 @@ func GetRunRunner() *RunRunner {
 	}
 
 	addEnvFlag(command, &runner.env)
+	command.Flags().BoolVar(&runner.envReport, "env-report", false,
+		"Report environment variables passed to, set for, or dropped from tasks")
+	command.Flags().StringVar(&runner.keepFiles, "keep-files", "",
+		"Keep task files directories: "+tasks.KeepFilesNever+", "+tasks.KeepFilesOnFailure+" (no value) or "+tasks.KeepFilesAlways)
+	command.Flags().Lookup("keep-files").NoOptDefVal = tasks.KeepFilesOnFailure
+	command.Flags().BoolVar(&runner.maskOutput, "mask-output", false,
+		"Mask secret values in commands standard output and error")
 	addModuleFlag(command, &runner.module)
 	addPropertyFlag(command, &runner.properties)
+	command.Flags().BoolVar(&runner.shellStrict, "shell-strict", false,
+		"Enable errexit, nounset and pipefail options of embedded shell commands")
+	command.Flags().BoolVar(&runner.strictVars, "strict-vars", false,
+		"Fail on references to undefined variables")
 	addVerboseFlag(command, &runner.verbose)
 	runner.timeout = command.Flags().DurationP("timeout", "t", 0,
 		"Duration after which task execution will be timed out")
+	command.Flags().BoolVar(&runner.traceShell, "trace-shell", false,
+		"Log commands executed by embedded shell scripts (implied by -vvv)")
 
 	runner.command = command
 
@@ -41,12 +54,18 @@ func RunCmd() *cobra.Command {
 
 // RunRunner is a context for the 'run' command.
 type RunRunner struct {
-	command    *cobra.Command
-	env        []string
-	module     string
-	properties []string
-	timeout    *time.Duration
-	verbose    int
+	command     *cobra.Command
+	env         []string
+	envReport   bool
+	keepFiles   string
+	maskOutput  bool
+	module      string
+	properties  []string
+	shellStrict bool
+	strictVars  bool
+	timeout     *time.Duration
+	traceShell  bool
+	verbose     int
 }
 
 // Run runs the 'run' command.
@@ -56,10 +75,16 @@ func (r *RunRunner) Run(_ *cobra.Command, args []string) {
 	err := tasks.Run(ctx, args[0],
 		tasks.WithArgs(args[1:]),
 		tasks.WithEnv(r.env),
+		tasks.WithEnvReport(r.envReport),
+		tasks.WithKeepFiles(r.keepFiles),
+		tasks.WithMaskOutput(r.maskOutput),
 		tasks.WithModule(r.module),
 		tasks.WithProperties(r.properties),
+		tasks.WithShellStrict(r.shellStrict),
+		tasks.WithStrictVars(r.strictVars),
 		tasks.WithVerbosity(r.verbose), // XXX not needed anymore?
-		tasks.WithTimeout(r.timeout))
+		tasks.WithTimeout(r.timeout),
+		tasks.WithTraceShell(r.traceShell))
 	if err != nil {
 		log.AsFatal(logger, err.Error())
 
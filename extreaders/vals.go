@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strings"
 
 	"github.com/apple/pkl-go/pkl"
 	"github.com/helmfile/vals"
+	"github.com/stoned/tpkl/internal/secrets"
 )
 
 const (
@@ -83,7 +85,8 @@ func (r ValsReader) ListElements(_ url.URL) ([]pkl.PathElement, error) {
 	return nil, nil
 }
 
-// Read evaluates a vals URL.
+// Read evaluates a vals URL. Values of `secretref+` URLs are recorded as
+// secrets to be masked.
 func (r ValsReader) Read(uri url.URL) ([]byte, error) {
 	// drop the `vals` scheme
 	uri.Scheme = ""
@@ -93,5 +96,9 @@ func (r ValsReader) Read(uri url.URL) ([]byte, error) {
 		return nil, fmt.Errorf("%w: %w", ErrValsEval, err)
 	}
 
+	if strings.HasPrefix(uri.String(), "secretref+") {
+		secrets.Add(value)
+	}
+
 	return []byte(value), nil
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/apple/pkl-go/pkl"
 	"github.com/stoned/tpkl/extreaders"
+	"github.com/stoned/tpkl/internal/secrets"
 )
 
 // TestModuleReaderImplementsPklModuleReaderInterface tests that extreaders.ModuleReader implements pkl.ModuleReader.
@@ -97,6 +98,38 @@ func TestValsReaderRead(t *testing.T) {
 	}
 }
 
+// TestValsReaderReadSecret test values of secret references are recorded as secrets.
+func TestValsReaderReadSecret(t *testing.T) {
+	t.Parallel()
+
+	valsReader, err := extreaders.NewValsResourceReader()
+	if err != nil {
+		t.Fatalf("cannot create a vals resource reader: %s", err)
+	}
+
+	for _, rawURL := range []string{
+		valsExpectedScheme + ":ref+echo://tpkl-test-not-secret",
+		valsExpectedScheme + ":secretref+echo://tpkl-test-secret",
+	} {
+		parsedURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("cannot parse URL %q: %s", rawURL, err)
+		}
+
+		_, err = valsReader.Read(*parsedURL)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	expected := "tpkl-test-not-secret ***"
+
+	got := secrets.Masked("tpkl-test-not-secret tpkl-test-secret")
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
 // TestValsDummy stupidly make us reach more test coverage.
 func TestValsDummy(t *testing.T) {
 	var reader extreaders.ModuleReader
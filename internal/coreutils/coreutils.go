@@ -0,0 +1,643 @@
+// Package coreutils implements portable versions of common utilities for
+// the mvdan.cc shell interpreter, so that embedded shell scripts behave the
+// same whatever the host utilities are.
+package coreutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+var (
+	// ErrInvalidInterval signals an invalid time interval.
+	ErrInvalidInterval = errors.New("invalid time interval")
+	// ErrIsDirectory signals a directory operand not allowed without `-r`.
+	ErrIsDirectory = errors.New("is a directory")
+	// ErrMissingOperand signals a missing operand.
+	ErrMissingOperand = errors.New("missing operand")
+	// ErrNotFound signals a command not found in PATH.
+	ErrNotFound = errors.New("not found")
+	// ErrRefused signals a refused operation, like removing the root directory.
+	ErrRefused = errors.New("refusing to operate")
+)
+
+// utility is a portable implementation of a utility, flags being the
+// single letter flags it supports and writes returning the operands it
+// creates, modifies or removes.
+type utility struct {
+	flags  string
+	run    func(ctx context.Context, hc *interp.HandlerContext, flags map[byte]bool, operands []string) error
+	writes func(operands []string) []string
+}
+
+//nolint:gochecknoglobals
+var utilities = map[string]utility{
+	"cat":   {flags: "", run: cat},
+	"cp":    {flags: "fRr", run: cp, writes: lastOperand},
+	"ls":    {flags: "1a", run: ls},
+	"mkdir": {flags: "p", run: mkdir, writes: allOperands},
+	"mv":    {flags: "f", run: mv, writes: allOperands},
+	"rm":    {flags: "fRr", run: rm, writes: allOperands},
+	"sleep": {flags: "", run: sleep},
+	"touch": {flags: "c", run: touch, writes: allOperands},
+	"which": {flags: "", run: which},
+}
+
+// Handled reports whether a command is run by the ExecHandler middleware,
+// and returns the operands it would create, modify or remove.
+func Handled(args []string) (bool, []string) {
+	util, ok := utilities[args[0]]
+	if !ok {
+		return false, nil
+	}
+
+	_, operands, ok := parseFlags(args[1:], util.flags)
+	if !ok {
+		return false, nil
+	}
+
+	if util.writes == nil {
+		return true, nil
+	}
+
+	return true, util.writes(operands)
+}
+
+func allOperands(operands []string) []string {
+	return operands
+}
+
+func lastOperand(operands []string) []string {
+	if len(operands) == 0 {
+		return nil
+	}
+
+	return operands[len(operands)-1:]
+}
+
+// ExecHandler is an mvdan.cc shell interpreter exec handler middleware
+// running the implemented utilities, falling back to next for other
+// commands and for flags not supported by the implementations.
+func ExecHandler(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(ctx context.Context, args []string) error {
+		util, ok := utilities[args[0]]
+		if !ok {
+			return next(ctx, args)
+		}
+
+		flags, operands, ok := parseFlags(args[1:], util.flags)
+		if !ok {
+			return next(ctx, args)
+		}
+
+		hc := interp.HandlerCtx(ctx)
+
+		err := util.run(ctx, &hc, flags, operands)
+		if err != nil {
+			_, _ = fmt.Fprintf(hc.Stderr, "%s: %v\n", args[0], err)
+
+			return interp.ExitStatus(1)
+		}
+
+		return nil
+	}
+}
+
+// parseFlags returns the single letter flags and the operands of a command,
+// and false if a flag is not a supported one. Flags may be grouped, e.g.
+// `-rf`, and `--` ends them.
+func parseFlags(args []string, supported string) (map[byte]bool, []string, bool) {
+	flags := make(map[byte]bool)
+
+	for idx, arg := range args {
+		if arg == "--" {
+			return flags, args[idx+1:], true
+		}
+
+		if len(arg) < 2 || arg[0] != '-' { //nolint:mnd
+			return flags, args[idx:], true
+		}
+
+		for _, flag := range []byte(arg[1:]) {
+			if strings.IndexByte(supported, flag) < 0 {
+				return nil, nil, false
+			}
+
+			flags[flag] = true
+		}
+	}
+
+	return flags, nil, true
+}
+
+// absPath returns a path relative to the interpreter directory as an
+// absolute one.
+func absPath(hc *interp.HandlerContext, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(hc.Dir, path)
+}
+
+func cat(_ context.Context, hc *interp.HandlerContext, _ map[byte]bool, operands []string) error {
+	if len(operands) == 0 {
+		operands = []string{"-"}
+	}
+
+	var errs []error
+
+	for _, operand := range operands {
+		if operand == "-" {
+			_, err := io.Copy(hc.Stdout, hc.Stdin)
+			if err != nil {
+				errs = append(errs, err)
+			}
+
+			continue
+		}
+
+		err := catFile(hc.Stdout, absPath(hc, operand))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func catFile(writer io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return unwrapPathError(err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = io.Copy(writer, file)
+
+	return unwrapPathError(err)
+}
+
+func cp(_ context.Context, hc *interp.HandlerContext, flags map[byte]bool, operands []string) error {
+	if len(operands) < 2 { //nolint:mnd
+		return ErrMissingOperand
+	}
+
+	recursive := flags['r'] || flags['R']
+	sources, target := operands[:len(operands)-1], absPath(hc, operands[len(operands)-1])
+	targetInfo, err := os.Stat(target)
+	intoDir := err == nil && targetInfo.IsDir()
+
+	if len(sources) > 1 && !intoDir {
+		return fmt.Errorf("%s: %w", operands[len(operands)-1], fs.ErrNotExist)
+	}
+
+	var errs []error
+
+	for _, source := range sources {
+		dest := target
+		if intoDir {
+			dest = filepath.Join(target, filepath.Base(source))
+		}
+
+		err = copyPath(absPath(hc, source), dest, recursive, false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CopyPath copies a file or, recursively, a directory tree, the symbolic
+// links it contains being copied as is, replacing existing symbolic links.
+func CopyPath(source, dest string) error {
+	return copyPath(source, dest, true, true)
+}
+
+func copyPath(source, dest string, recursive bool, replaceLinks bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return unwrapPathError(err)
+	}
+
+	if !info.IsDir() {
+		return copyFile(source, dest, info.Mode().Perm())
+	}
+
+	if !recursive {
+		return ErrIsDirectory
+	}
+
+	return filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(dest, rel)
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(destPath, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			if replaceLinks {
+				info, err := os.Lstat(destPath)
+				if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+					err = os.Remove(destPath)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return os.Symlink(link, destPath)
+		default:
+			return copyFile(path, destPath, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(source, dest string, mode fs.FileMode) error {
+	reader, err := os.Open(source)
+	if err != nil {
+		return unwrapPathError(err)
+	}
+
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	writer, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return unwrapPathError(err)
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		_ = writer.Close()
+
+		return unwrapPathError(err)
+	}
+
+	return unwrapPathError(writer.Close())
+}
+
+func ls(_ context.Context, hc *interp.HandlerContext, flags map[byte]bool, operands []string) error {
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+
+	var (
+		errs  []error
+		files []string
+		dirs  []string
+	)
+
+	for _, operand := range operands {
+		info, err := os.Stat(absPath(hc, operand))
+
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", operand, unwrapPathError(err)))
+		case info.IsDir():
+			dirs = append(dirs, operand)
+		default:
+			files = append(files, operand)
+		}
+	}
+
+	slices.Sort(files)
+	slices.Sort(dirs)
+
+	for _, file := range files {
+		_, _ = fmt.Fprintln(hc.Stdout, file)
+	}
+
+	for idx, dir := range dirs {
+		if len(operands) > 1 {
+			if idx > 0 || len(files) > 0 {
+				_, _ = fmt.Fprintln(hc.Stdout)
+			}
+
+			_, _ = fmt.Fprintf(hc.Stdout, "%s:\n", dir)
+		}
+
+		entries, err := os.ReadDir(absPath(hc, dir))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dir, unwrapPathError(err)))
+
+			continue
+		}
+
+		if flags['a'] {
+			_, _ = fmt.Fprintln(hc.Stdout, ".")
+			_, _ = fmt.Fprintln(hc.Stdout, "..")
+		}
+
+		for _, entry := range entries {
+			if flags['a'] || !strings.HasPrefix(entry.Name(), ".") {
+				_, _ = fmt.Fprintln(hc.Stdout, entry.Name())
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func mkdir(_ context.Context, hc *interp.HandlerContext, flags map[byte]bool, operands []string) error {
+	if len(operands) == 0 {
+		return ErrMissingOperand
+	}
+
+	var errs []error
+
+	for _, operand := range operands {
+		var err error
+
+		if flags['p'] {
+			err = os.MkdirAll(absPath(hc, operand), 0o777) //nolint:mnd
+		} else {
+			err = os.Mkdir(absPath(hc, operand), 0o777) //nolint:mnd
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, unwrapPathError(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func mv(_ context.Context, hc *interp.HandlerContext, _ map[byte]bool, operands []string) error {
+	if len(operands) < 2 { //nolint:mnd
+		return ErrMissingOperand
+	}
+
+	sources, target := operands[:len(operands)-1], absPath(hc, operands[len(operands)-1])
+	targetInfo, err := os.Stat(target)
+	intoDir := err == nil && targetInfo.IsDir()
+
+	if len(sources) > 1 && !intoDir {
+		return fmt.Errorf("%s: %w", operands[len(operands)-1], fs.ErrNotExist)
+	}
+
+	var errs []error
+
+	for _, source := range sources {
+		dest := target
+		if intoDir {
+			dest = filepath.Join(target, filepath.Base(source))
+		}
+
+		err = movePath(absPath(hc, source), dest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, unwrapLinkError(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// movePath renames source to dest or, when they are on different file
+// systems, copies source to dest then removes it.
+func movePath(source, dest string) error {
+	err := os.Rename(source, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err //nolint:wrapcheck
+	}
+
+	info, err := os.Lstat(source)
+	if err != nil {
+		return unwrapPathError(err)
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return unwrapPathError(err)
+		}
+
+		err = os.Symlink(link, dest)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	} else {
+		err = CopyPath(source, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(source) //nolint:wrapcheck
+}
+
+func rm(_ context.Context, hc *interp.HandlerContext, flags map[byte]bool, operands []string) error {
+	force := flags['f']
+	recursive := flags['r'] || flags['R']
+
+	if len(operands) == 0 && !force {
+		return ErrMissingOperand
+	}
+
+	var errs []error
+
+	for _, operand := range operands {
+		path := absPath(hc, operand)
+
+		base := filepath.Base(operand)
+		if base == "." || base == ".." || filepath.Dir(path) == path {
+			errs = append(errs, fmt.Errorf("%w on `%s`", ErrRefused, operand))
+
+			continue
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			if !force || !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("%s: %w", operand, unwrapPathError(err)))
+			}
+
+			continue
+		}
+
+		switch {
+		case info.IsDir() && !recursive:
+			err = ErrIsDirectory
+		case info.IsDir():
+			err = os.RemoveAll(path)
+		default:
+			err = os.Remove(path)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, unwrapPathError(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func sleep(ctx context.Context, _ *interp.HandlerContext, _ map[byte]bool, operands []string) error {
+	if len(operands) == 0 {
+		return ErrMissingOperand
+	}
+
+	var total time.Duration
+
+	for _, operand := range operands {
+		duration, err := parseInterval(operand)
+		if err != nil {
+			return err
+		}
+
+		total += min(duration, maxInterval-total)
+	}
+
+	timer := time.NewTimer(total)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// maxInterval is the longest sleep time interval, the one of `infinity`.
+const maxInterval time.Duration = math.MaxInt64
+
+// parseInterval parses a sleep time interval, a number of seconds,
+// optionally decimal, with an optional `s`, `m`, `h` or `d` unit suffix.
+// Intervals too long to be represented, like `infinity`, are maxInterval.
+func parseInterval(interval string) (time.Duration, error) {
+	unit := time.Second
+	number := interval
+
+	switch {
+	case strings.HasSuffix(interval, "s"):
+		number = strings.TrimSuffix(interval, "s")
+	case strings.HasSuffix(interval, "m"):
+		number, unit = strings.TrimSuffix(interval, "m"), time.Minute
+	case strings.HasSuffix(interval, "h"):
+		number, unit = strings.TrimSuffix(interval, "h"), time.Hour
+	case strings.HasSuffix(interval, "d"):
+		number, unit = strings.TrimSuffix(interval, "d"), 24*time.Hour //nolint:mnd
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 || math.IsNaN(value) {
+		return 0, fmt.Errorf("%w: `%s`", ErrInvalidInterval, interval)
+	}
+
+	if value*float64(unit) >= float64(maxInterval) {
+		return maxInterval, nil
+	}
+
+	return time.Duration(value * float64(unit)), nil
+}
+
+func touch(_ context.Context, hc *interp.HandlerContext, flags map[byte]bool, operands []string) error {
+	if len(operands) == 0 {
+		return ErrMissingOperand
+	}
+
+	var errs []error
+
+	now := time.Now()
+
+	for _, operand := range operands {
+		path := absPath(hc, operand)
+
+		err := os.Chtimes(path, now, now)
+		if errors.Is(err, fs.ErrNotExist) && !flags['c'] {
+			var file *os.File
+
+			file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o666) //nolint:mnd
+			if err == nil {
+				err = file.Close()
+			}
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, unwrapPathError(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func which(_ context.Context, hc *interp.HandlerContext, _ map[byte]bool, operands []string) error {
+	if len(operands) == 0 {
+		return ErrMissingOperand
+	}
+
+	var errs []error
+
+	for _, operand := range operands {
+		path, err := interp.LookPathDir(hc.Dir, hc.Env, operand)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, ErrNotFound))
+
+			continue
+		}
+
+		_, _ = fmt.Fprintln(hc.Stdout, path)
+	}
+
+	return errors.Join(errs...)
+}
+
+// unwrapPathError returns the underlying error of a *fs.PathError, whose
+// path is the absolute one, operands being reported as given.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+
+	return err
+}
+
+// unwrapLinkError returns the underlying error of a *os.LinkError.
+func unwrapLinkError(err error) error {
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return linkErr.Err
+	}
+
+	return err
+}
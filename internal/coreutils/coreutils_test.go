@@ -0,0 +1,375 @@
+package coreutils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stoned/tpkl/internal/coreutils"
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// run runs a script in dir with the coreutils exec handler, returning its
+// standard output and error, and the commands falling back to the host ones.
+func run(t *testing.T, dir string, script string) (string, string, []string, error) {
+	t.Helper()
+
+	var (
+		stdout, stderr bytes.Buffer
+		fallbacks      []string
+	)
+
+	fallback := func(_ interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+		return func(_ context.Context, args []string) error {
+			fallbacks = append(fallbacks, strings.Join(args, " "))
+
+			return nil
+		}
+	}
+
+	file, err := syntax.NewParser().Parse(strings.NewReader(script), t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner, err := interp.New(
+		interp.Dir(dir),
+		interp.Env(expand.ListEnviron("PATH="+filepath.Join(dir, "bin"))),
+		interp.StdIO(strings.NewReader("input\n"), &stdout, &stderr),
+		interp.ExecHandlers(coreutils.ExecHandler, fallback),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runner.Run(t.Context(), file)
+
+	return stdout.String(), stderr.String(), fallbacks, err
+}
+
+// TestExecHandler tests the utilities implemented by the ExecHandler middleware.
+func TestExecHandler(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		script    string
+		stdout    string
+		fallbacks []string
+	}{
+		{
+			name:   "mkdir touch ls",
+			script: "mkdir -p a/b/c; touch a/f a/.hidden; ls a; ls -a a/b",
+			stdout: "b\nf\n.\n..\nc\n",
+		},
+		{
+			name:   "cat",
+			script: "mkdir d; echo hello >d/f; cat d/f - d/f",
+			stdout: "hello\ninput\nhello\n",
+		},
+		{
+			name:   "cp mv",
+			script: "mkdir -p a/b; echo x >a/b/f; cp -r a c; mv c/b/f c/g; cat c/g; ls c/b a/b",
+			stdout: "x\na/b:\nf\n\nc/b:\n",
+		},
+		{
+			name:   "cp into directory",
+			script: "mkdir d; echo x >f; echo y >g; cp f g d; ls d",
+			stdout: "f\ng\n",
+		},
+		{
+			name:   "rm",
+			script: "mkdir -p a/b; touch f; rm f; rm -rf a missing; ls",
+			stdout: "",
+		},
+		{
+			name:   "sleep",
+			script: "sleep 0.01 0s",
+		},
+		{
+			name:      "fallback",
+			script:    "mkdir -v d; ls -l; cp --recursive a b; unknown -x",
+			fallbacks: []string{"mkdir -v d", "ls -l", "cp --recursive a b", "unknown -x"},
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+
+			stdout, stderr, fallbacks, err := run(t, dir, tcase.script)
+			if err != nil {
+				t.Fatalf("unexpected error: %v: %s", err, stderr)
+			}
+
+			stdout = strings.ReplaceAll(stdout, dir+string(filepath.Separator), "")
+
+			if diff := cmp.Diff(tcase.stdout, stdout); diff != "" {
+				t.Errorf("stdout mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tcase.fallbacks, fallbacks); diff != "" {
+				t.Errorf("fallbacks mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestWhich tests that which searches PATH of the interpreter environment.
+func TestWhich(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(dir, "bin"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "bin", "tool"), nil, 0o700) //nolint:gosec
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, _, err := run(t, dir, "which tool")
+	if err != nil {
+		t.Fatalf("unexpected error: %v: %s", err, stderr)
+	}
+
+	if diff := cmp.Diff(filepath.Join(dir, "bin", "tool")+"\n", stdout); diff != "" {
+		t.Errorf("stdout mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestHandled tests the commands run by the ExecHandler middleware and the
+// operands they write.
+func TestHandled(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		args    []string
+		handled bool
+		writes  []string
+	}{
+		{args: []string{"cat", "a", "b"}, handled: true},
+		{args: []string{"cp", "-r", "a", "b", "c"}, handled: true, writes: []string{"c"}},
+		{args: []string{"rm", "-rf", "--", "-a", "b"}, handled: true, writes: []string{"-a", "b"}},
+		{args: []string{"mkdir", "-v", "d"}},
+		{args: []string{"unknown"}},
+	}
+
+	for _, tcase := range cases {
+		handled, writes := coreutils.Handled(tcase.args)
+		if handled != tcase.handled {
+			t.Errorf("%v: expected handled %t", tcase.args, tcase.handled)
+		}
+
+		if diff := cmp.Diff(tcase.writes, writes); diff != "" {
+			t.Errorf("%v: writes mismatch (-want +got):\n%s", tcase.args, diff)
+		}
+	}
+}
+
+// TestExecHandlerErrors tests failing utilities.
+func TestExecHandlerErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		script string
+		stderr string
+	}{
+		{name: "rm missing", script: "rm missing", stderr: "rm: missing: no such file or directory\n"},
+		{name: "rm directory", script: "mkdir d; rm d", stderr: "rm: d: is a directory\n"},
+		{name: "rm dot", script: "rm -rf .", stderr: "rm: refusing to operate on `.`\n"},
+		{name: "rm root", script: "rm -rf /", stderr: "rm: refusing to operate on `/`\n"},
+		{name: "mkdir existing", script: "mkdir d; mkdir d", stderr: "mkdir: d: file exists\n"},
+		{name: "cp directory", script: "mkdir d; cp d e", stderr: "cp: d: is a directory\n"},
+		{name: "cp missing operand", script: "cp f", stderr: "cp: missing operand\n"},
+		{name: "which", script: "which missing", stderr: "which: missing: not found\n"},
+		{name: "sleep", script: "sleep 1x", stderr: "sleep: invalid time interval: `1x`\n"},
+		{name: "sleep nan", script: "sleep nan", stderr: "sleep: invalid time interval: `nan`\n"},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, stderr, _, err := run(t, t.TempDir(), tcase.script)
+			if status, ok := interp.IsExitStatus(err); !ok || status != 1 {
+				t.Errorf("expected exit status 1, got %v", err)
+			}
+
+			if diff := cmp.Diff(tcase.stderr, stderr); diff != "" {
+				t.Errorf("stderr mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestSleepInfinity tests that sleep blocks until its context is done when
+// its interval is infinite or too long to be represented.
+func TestSleepInfinity(t *testing.T) {
+	t.Parallel()
+
+	for _, script := range []string{"sleep infinity", "sleep inf 1", "sleep 1e300d"} {
+		t.Run(script, func(t *testing.T) {
+			t.Parallel()
+
+			file, err := syntax.NewParser().Parse(strings.NewReader(script), t.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runner, err := interp.New(interp.ExecHandlers(coreutils.ExecHandler))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+
+			err = runner.Run(ctx, file)
+			if err == nil || time.Since(start) < 50*time.Millisecond {
+				t.Errorf("expected sleep until the context is done, got %v after %v", err, time.Since(start))
+			}
+		})
+	}
+}
+
+// TestRmKeepsOutside tests that rm does not follow symbolic links.
+func TestRmKeepsOutside(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(outside, "f"), nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink(outside, filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, _, err := run(t, dir, "rm -r link")
+	if err != nil {
+		t.Fatalf("unexpected error: %v: %s", err, stderr)
+	}
+
+	_, err = os.Stat(filepath.Join(outside, "f"))
+	if err != nil {
+		t.Errorf("file outside removed: %v", err)
+	}
+}
+
+// TestCopyPath tests that directory trees are copied with their symbolic links,
+// again over a previous copy.
+func TestCopyPath(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "src", "sub"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "src", "sub", "f"), []byte("content"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink("sub/f", filepath.Join(dir, "src", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		err = coreutils.CopyPath(filepath.Join(dir, "src"), filepath.Join(dir, "dest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "dest", "sub", "f"))
+	if err != nil || string(data) != "content" {
+		t.Errorf("unexpected copy content %q: %v", data, err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dir, "dest", "link"))
+	if err != nil || link != "sub/f" {
+		t.Errorf("unexpected copy link %q: %v", link, err)
+	}
+}
+
+// TestMvAcrossFileSystems tests that mv copies then removes files it cannot
+// rename, when they are on different file systems.
+func TestMvAcrossFileSystems(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	outside, err := os.MkdirTemp("/dev/shm", "tpkl-test-")
+	if err != nil {
+		t.Skipf("no other file system: %v", err)
+	}
+
+	t.Cleanup(func() { _ = os.RemoveAll(outside) })
+
+	err = os.WriteFile(filepath.Join(outside, "probe"), nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Rename(filepath.Join(outside, "probe"), filepath.Join(dir, "probe"))
+	if !errors.Is(err, syscall.EXDEV) {
+		t.Skipf("%s is on the same file system as %s", outside, dir)
+	}
+
+	err = os.MkdirAll(filepath.Join(outside, "tree", "sub"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(outside, "tree", "sub", "f"), []byte("content"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink("sub/f", filepath.Join(outside, "tree", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, _, err := run(t, dir, "mv "+filepath.Join(outside, "tree")+" moved")
+	if err != nil {
+		t.Fatalf("unexpected error: %v: %s", err, stderr)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "moved", "link"))
+	if err != nil || string(data) != "content" {
+		t.Errorf("unexpected moved content %q: %v", data, err)
+	}
+
+	_, err = os.Stat(filepath.Join(outside, "tree"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("source not removed: %v", err)
+	}
+}
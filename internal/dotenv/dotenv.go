@@ -0,0 +1,269 @@
+// Package dotenv parses environment files in the `.env` format.
+package dotenv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrSyntax signals a syntax error in an environment file.
+var ErrSyntax = errors.New("syntax error")
+
+// Parse returns the variables assigned in an environment file.
+//
+// Each non blank line is either a comment starting with `#` or a
+// `NAME=VALUE` assignment, optionally prefixed with `export`. Values
+// may be single quoted (taken literally), double quoted (supporting
+// `\n`, `\r`, `\t`, `\"`, `\\` and `\$` escapes) or unquoted, in which
+// case a `#` preceded by a blank starts a comment. Quoted values may
+// span several lines. No variable interpolation is done.
+func Parse(reader io.Reader) (map[string]string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading environment file: %w", err)
+	}
+
+	parser := &parser{input: string(data), line: 1}
+	vars := make(map[string]string)
+
+	for {
+		name, value, ok, err := parser.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return vars, nil
+		}
+
+		vars[name] = value
+	}
+}
+
+type parser struct {
+	input string
+	pos   int
+	line  int
+}
+
+// next returns the next assignment, or false at the end of the input.
+func (p *parser) next() (string, string, bool, error) {
+	for {
+		p.skipBlanks()
+
+		if p.eof() {
+			return "", "", false, nil
+		}
+
+		switch p.peek() {
+		case '\n':
+			p.advance()
+
+			continue
+		case '#':
+			p.skipLine()
+
+			continue
+		}
+
+		name, value, err := p.assignment()
+		if err != nil {
+			return "", "", false, err
+		}
+
+		return name, value, true, nil
+	}
+}
+
+func (p *parser) assignment() (string, string, error) {
+	name := p.name()
+	if name == "export" && !p.eof() && isBlank(p.peek()) {
+		p.skipBlanks()
+		name = p.name()
+	}
+
+	if name == "" {
+		return "", "", p.errorf("invalid variable name")
+	}
+
+	p.skipBlanks()
+
+	if p.eof() || p.peek() != '=' {
+		return "", "", p.errorf("missing `=` after variable name `%s`", name)
+	}
+
+	p.advance()
+	p.skipBlanks()
+
+	var (
+		value string
+		err   error
+	)
+
+	switch {
+	case p.eof():
+	case p.peek() == '\'':
+		value, err = p.singleQuoted()
+	case p.peek() == '"':
+		value, err = p.doubleQuoted()
+	default:
+		value = p.unquoted()
+	}
+
+	if err != nil {
+		return "", "", err
+	}
+
+	p.skipBlanks()
+
+	if !p.eof() && p.peek() == '#' {
+		p.skipLine()
+	}
+
+	if !p.eof() && p.peek() != '\n' {
+		return "", "", p.errorf("unexpected characters after value of variable `%s`", name)
+	}
+
+	return name, value, nil
+}
+
+func (p *parser) name() string {
+	start := p.pos
+
+	for !p.eof() && isNameChar(p.peek(), p.pos == start) {
+		p.pos++
+	}
+
+	return p.input[start:p.pos]
+}
+
+func (p *parser) singleQuoted() (string, error) {
+	line := p.line
+
+	p.advance()
+
+	start := p.pos
+
+	for !p.eof() && p.peek() != '\'' {
+		p.advance()
+	}
+
+	if p.eof() {
+		return "", p.errorAt(line, "unterminated single quoted value")
+	}
+
+	value := p.input[start:p.pos]
+
+	p.advance()
+
+	return value, nil
+}
+
+func (p *parser) doubleQuoted() (string, error) {
+	var value strings.Builder
+
+	line := p.line
+
+	p.advance()
+
+	for !p.eof() && p.peek() != '"' {
+		char := p.advance()
+		if char != '\\' || p.eof() {
+			value.WriteByte(char)
+
+			continue
+		}
+
+		switch escaped := p.advance(); escaped {
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		case 't':
+			value.WriteByte('\t')
+		case '"', '\\', '$':
+			value.WriteByte(escaped)
+		default:
+			value.WriteByte('\\')
+			value.WriteByte(escaped)
+		}
+	}
+
+	if p.eof() {
+		return "", p.errorAt(line, "unterminated double quoted value")
+	}
+
+	p.advance()
+
+	return value.String(), nil
+}
+
+func (p *parser) unquoted() string {
+	start := p.pos
+
+	for !p.eof() && p.peek() != '\n' {
+		if p.peek() == '#' && p.pos > start && isBlank(p.input[p.pos-1]) {
+			break
+		}
+
+		p.pos++
+	}
+
+	return strings.TrimRight(p.input[start:p.pos], " \t\r")
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	return p.input[p.pos]
+}
+
+func (p *parser) advance() byte {
+	char := p.input[p.pos]
+	if char == '\n' {
+		p.line++
+	}
+
+	p.pos++
+
+	return char
+}
+
+func (p *parser) skipBlanks() {
+	for !p.eof() && isBlank(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *parser) skipLine() {
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return p.errorAt(p.line, format, args...)
+}
+
+func (p *parser) errorAt(line int, format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", ErrSyntax, line, fmt.Sprintf(format, args...))
+}
+
+func isBlank(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\r'
+}
+
+func isNameChar(char byte, first bool) bool {
+	switch {
+	case char == '_', 'a' <= char && char <= 'z', 'A' <= char && char <= 'Z':
+		return true
+	case '0' <= char && char <= '9':
+		return !first
+	default:
+		return false
+	}
+}
@@ -0,0 +1,82 @@
+package dotenv_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stoned/tpkl/internal/dotenv"
+)
+
+// TestParse tests the Parse function.
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		input    string
+		expected map[string]string
+	}{
+		{name: "empty", input: "", expected: map[string]string{}},
+		{name: "comments", input: "# comment\n\n  # indented comment\n", expected: map[string]string{}},
+		{name: "simple", input: "FOO=bar\nBAZ=qux", expected: map[string]string{"FOO": "bar", "BAZ": "qux"}},
+		{name: "empty value", input: "FOO=\nBAR=", expected: map[string]string{"FOO": "", "BAR": ""}},
+		{name: "blanks", input: "  FOO = bar  \r\n", expected: map[string]string{"FOO": "bar"}},
+		{name: "export", input: "export FOO=bar\nexport\tBAR=baz", expected: map[string]string{"FOO": "bar", "BAR": "baz"}},
+		{name: "export as name", input: "export=bar", expected: map[string]string{"export": "bar"}},
+		{name: "inline comment", input: "FOO=bar # comment\nBAR=b#az", expected: map[string]string{"FOO": "bar", "BAR": "b#az"}},
+		{name: "single quoted", input: `FOO='b\n $ar' # comment`, expected: map[string]string{"FOO": `b\n $ar`}},
+		{name: "double quoted", input: `FOO="a\tb\n\"c\" \\ \$d \x"`, expected: map[string]string{"FOO": "a\tb\n\"c\" \\ $d \\x"}},
+		{name: "quoted hash", input: `FOO="bar # baz"`, expected: map[string]string{"FOO": "bar # baz"}},
+		{name: "multiline", input: "FOO=\"one\ntwo\"\nBAR='three\nfour'\n", expected: map[string]string{"FOO": "one\ntwo", "BAR": "three\nfour"}},
+		{name: "override", input: "FOO=one\nFOO=two", expected: map[string]string{"FOO": "two"}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			vars, err := dotenv.Parse(strings.NewReader(testCase.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if diff := cmp.Diff(testCase.expected, vars); diff != "" {
+				t.Errorf("Mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestParseErrors tests the Parse function with invalid inputs.
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		input   string
+		message string
+	}{
+		{name: "invalid name", input: "1FOO=bar", message: "line 1: invalid variable name"},
+		{name: "missing equal", input: "\nFOO bar", message: "line 2: missing `=`"},
+		{name: "unterminated single quote", input: "FOO='bar\n\n", message: "line 1: unterminated single quoted"},
+		{name: "unterminated double quote", input: "\n\nFOO=\"bar", message: "line 3: unterminated double quoted"},
+		{name: "trailing characters", input: `FOO="bar"baz`, message: "line 1: unexpected characters"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := dotenv.Parse(strings.NewReader(testCase.input))
+			if !errors.Is(err, dotenv.ErrSyntax) {
+				t.Fatalf("expected error %q, got %v", dotenv.ErrSyntax, err)
+			}
+
+			if !strings.Contains(err.Error(), testCase.message) {
+				t.Errorf("expected error message to contain %q, got %q", testCase.message, err)
+			}
+		})
+	}
+}
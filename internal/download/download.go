@@ -0,0 +1,303 @@
+// Package download downloads files over HTTP, verifying their SHA-256
+// checksum, and writing them atomically.
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrChecksum signals a downloaded file not having the expected checksum.
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrStatus signals an HTTP response status other than 2xx.
+	ErrStatus = errors.New("unexpected HTTP status")
+)
+
+// defaultRetryDelay is the delay before the first retry, doubled before
+// each following one.
+const defaultRetryDelay = 500 * time.Millisecond
+
+// defaultMode is the mode of downloaded files, before the umask, when their
+// destination does not exist.
+const defaultMode fs.FileMode = 0o666
+
+// Request is a file to download.
+type Request struct {
+	URL         string
+	Destination string
+	// SHA256 is the expected hexadecimal checksum of the file.
+	SHA256  string
+	Headers map[string]string
+	// Mode is the mode of the file, defaulting to the one of an existing
+	// destination, or to 0o666 minus the umask.
+	Mode *fs.FileMode
+	// Retries is the number of times a download failing with a network error,
+	// or a 429 or 5xx status, is retried.
+	Retries int
+	// RetryDelay is the delay before the first retry, defaulting to 500ms.
+	RetryDelay time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// File downloads a file, unless its destination already has the expected
+// checksum, and reports whether it was downloaded. The file is written to a
+// temporary file in the destination directory, renamed once verified. An
+// existing destination that is not downloaded again still gets Mode, if set.
+func File(ctx context.Context, request Request) (bool, error) {
+	matches, err := Matches(request.Destination, request.SHA256)
+	if err != nil {
+		return false, err
+	}
+
+	if matches {
+		if request.Mode != nil {
+			err = os.Chmod(request.Destination, *request.Mode)
+			if err != nil {
+				return false, err //nolint:wrapcheck
+			}
+		}
+
+		return false, nil
+	}
+
+	delay := request.RetryDelay
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = fetch(ctx, request)
+		if err == nil || attempt >= request.Retries || !retryable(err) {
+			return err == nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf("%w: %w", err, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// Matches reports whether a file exists and has the expected checksum.
+func Matches(path string, expected string) (bool, error) {
+	file, err := os.Open(path) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err //nolint:wrapcheck
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return false, err //nolint:wrapcheck
+	}
+
+	return strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), expected), nil
+}
+
+// fetch downloads a file once.
+func fetch(ctx context.Context, request Request) error {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, request.URL, nil)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	for name, value := range request.Headers {
+		httpRequest.Header.Set(name, value)
+	}
+
+	client := request.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return &statusError{code: response.StatusCode, status: response.Status}
+	}
+
+	mode, exact := fileMode(request)
+
+	temp, err := createTemp(request.Destination, mode)
+	if err != nil {
+		return err
+	}
+
+	if exact {
+		err = temp.Chmod(mode)
+	}
+
+	if err == nil {
+		err = write(temp, &bodyReader{response.Body}, request.SHA256)
+	} else {
+		_ = temp.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(temp.Name(), request.Destination)
+	}
+
+	if err != nil {
+		_ = os.Remove(temp.Name())
+	}
+
+	return err
+}
+
+// fileMode returns the mode of a downloaded file, and whether it is set
+// exactly rather than before the umask.
+func fileMode(request Request) (fs.FileMode, bool) {
+	if request.Mode != nil {
+		return *request.Mode, true
+	}
+
+	info, err := os.Stat(request.Destination)
+	if err == nil {
+		return info.Mode().Perm(), true
+	}
+
+	return defaultMode, false
+}
+
+// createTemp creates a new temporary file next to dest, with mode perm
+// before the umask.
+func createTemp(dest string, perm fs.FileMode) (*os.File, error) {
+	for {
+		name := "." + filepath.Base(dest) + "." + strconv.FormatUint(uint64(rand.Uint32()), 10) //nolint:gosec
+
+		file, err := os.OpenFile(filepath.Join(filepath.Dir(dest), name), os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if !errors.Is(err, fs.ErrExist) {
+			return file, err //nolint:wrapcheck
+		}
+	}
+}
+
+// write writes a downloaded file to its temporary file, verifying its checksum,
+// and closes the temporary file.
+func write(temp *os.File, body io.Reader, expected string) error {
+	hash := sha256.New()
+
+	_, err := io.Copy(io.MultiWriter(temp, hash), body)
+	if err != nil {
+		_ = temp.Close()
+
+		return err //nolint:wrapcheck
+	}
+
+	err = temp.Close()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksum, expected, actual)
+	}
+
+	return nil
+}
+
+// statusError is an HTTP response status other than 2xx.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrStatus, e.status)
+}
+
+func (e *statusError) Unwrap() error {
+	return ErrStatus
+}
+
+// bodyReader is the body of a response, whose read errors are network errors.
+type bodyReader struct {
+	body io.Reader
+}
+
+func (r *bodyReader) Read(data []byte) (int, error) {
+	count, err := r.body.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = &networkError{err}
+	}
+
+	return count, err
+}
+
+// networkError is an error reading the body of a response.
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *networkError) Unwrap() error {
+	return e.err
+}
+
+// retryable reports whether a failed download may succeed when retried: on
+// network errors, server errors and rate limiting, and not on local errors,
+// e.g. failing to write the file, invalid URLs or checksum mismatches.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var (
+		statusErr  *statusError
+		networkErr *networkError
+		urlErr     *url.Error
+		netErr     net.Error
+	)
+
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= http.StatusInternalServerError
+	case errors.As(err, &networkErr):
+		return true
+	case errors.As(err, &urlErr):
+		// Errors of requests, e.g. invalid URLs, are url.Error values too.
+		return errors.As(urlErr.Err, &netErr) || errors.Is(urlErr.Err, io.EOF) ||
+			errors.Is(urlErr.Err, io.ErrUnexpectedEOF)
+	default:
+		return false
+	}
+}
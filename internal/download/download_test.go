@@ -0,0 +1,297 @@
+package download_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stoned/tpkl/internal/download"
+)
+
+const content = "downloaded content\n"
+
+// checksum is the SHA-256 checksum of content.
+func checksum() string {
+	sum := sha256.Sum256([]byte(content))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// newServer returns a test server answering with content, after failing
+// with status the first failures requests, and counting requests.
+func newServer(t *testing.T, status int, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if requests.Add(1) <= failures {
+			writer.WriteHeader(status)
+
+			return
+		}
+
+		if request.Header.Get("Authorization") != "Bearer token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		_, _ = writer.Write([]byte(content))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+// newRequest returns a request of the test server file, to a destination
+// in a temporary directory.
+func newRequest(t *testing.T, server *httptest.Server) download.Request {
+	t.Helper()
+
+	return download.Request{
+		URL:         server.URL + "/file",
+		Destination: filepath.Join(t.TempDir(), "file"),
+		SHA256:      checksum(),
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		RetryDelay:  time.Millisecond,
+	}
+}
+
+// TestFile tests that files are downloaded once, then skipped.
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	server, requests := newServer(t, http.StatusOK, 0)
+	request := newRequest(t, server)
+
+	downloaded, err := download.File(t.Context(), request)
+	if err != nil || !downloaded {
+		t.Fatalf("expected download, got %t: %v", downloaded, err)
+	}
+
+	data, err := os.ReadFile(request.Destination)
+	if err != nil || string(data) != content {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+
+	downloaded, err = download.File(t.Context(), request)
+	if err != nil || downloaded {
+		t.Errorf("expected skipped download, got %t: %v", downloaded, err)
+	}
+
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request, got %d", requests.Load())
+	}
+}
+
+// TestFileRetries tests that server errors are retried and client errors not.
+func TestFileRetries(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		status   int
+		failures int32
+		retries  int
+		requests int32
+		err      error
+	}{
+		{name: "retried", status: http.StatusServiceUnavailable, failures: 2, retries: 2, requests: 3},
+		{name: "exhausted", status: http.StatusBadGateway, failures: 3, retries: 2, requests: 3, err: download.ErrStatus},
+		{name: "rate limited", status: http.StatusTooManyRequests, failures: 1, retries: 1, requests: 2},
+		{name: "final", status: http.StatusNotFound, failures: 1, retries: 3, requests: 1, err: download.ErrStatus},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, requests := newServer(t, tcase.status, tcase.failures)
+			request := newRequest(t, server)
+			request.Retries = tcase.retries
+
+			_, err := download.File(t.Context(), request)
+			if !errors.Is(err, tcase.err) {
+				t.Errorf("expected error %v, got %v", tcase.err, err)
+			}
+
+			if requests.Load() != tcase.requests {
+				t.Errorf("expected %d requests, got %d", tcase.requests, requests.Load())
+			}
+		})
+	}
+}
+
+// TestFileRetriesNetwork tests that network errors are retried.
+func TestFileRetriesNetwork(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) == 1 {
+			conn, _, err := http.NewResponseController(writer).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+
+			return
+		}
+
+		_, _ = writer.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+
+	request := newRequest(t, server)
+	request.Retries = 1
+
+	downloaded, err := download.File(t.Context(), request)
+	if err != nil || !downloaded {
+		t.Errorf("expected download, got %t: %v", downloaded, err)
+	}
+
+	if requests.Load() != 2 {
+		t.Errorf("expected 2 requests, got %d", requests.Load())
+	}
+}
+
+// TestFileNotRetried tests that local failures are not retried.
+func TestFileNotRetried(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		update func(request *download.Request)
+		err    error
+	}{
+		{
+			name:   "checksum mismatch",
+			update: func(request *download.Request) { request.SHA256 = strings.Repeat("0", 64) },
+			err:    download.ErrChecksum,
+		},
+		{
+			name: "missing directory",
+			update: func(request *download.Request) {
+				request.Destination = filepath.Join(filepath.Dir(request.Destination), "missing", "file")
+			},
+			err: fs.ErrNotExist,
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, requests := newServer(t, http.StatusOK, 0)
+			request := newRequest(t, server)
+			request.Retries = 3
+			tcase.update(&request)
+
+			_, err := download.File(t.Context(), request)
+			if !errors.Is(err, tcase.err) {
+				t.Errorf("expected error %v, got %v", tcase.err, err)
+			}
+
+			if requests.Load() != 1 {
+				t.Errorf("expected 1 request, got %d", requests.Load())
+			}
+		})
+	}
+}
+
+// TestFileMode tests that downloaded files get the mode of the destination
+// they replace, unless set.
+func TestFileMode(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newServer(t, http.StatusOK, 0)
+
+	request := newRequest(t, server)
+
+	err := os.WriteFile(request.Destination, []byte("previous"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(request.Destination, 0o751)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = download.File(t.Context(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(request.Destination)
+	if err != nil || info.Mode().Perm() != 0o751 {
+		t.Errorf("expected mode 0751, got %v: %v", info.Mode(), err)
+	}
+
+	request = newRequest(t, server)
+	mode := fs.FileMode(0o705)
+	request.Mode = &mode
+
+	_, err = download.File(t.Context(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = os.Stat(request.Destination)
+	if err != nil || info.Mode().Perm() != mode {
+		t.Errorf("expected mode %v, got %v: %v", mode, info.Mode(), err)
+	}
+
+	mode = fs.FileMode(0o600)
+
+	downloaded, err := download.File(t.Context(), request)
+	if err != nil || downloaded {
+		t.Fatalf("expected no download, got %v: %v", downloaded, err)
+	}
+
+	info, err = os.Stat(request.Destination)
+	if err != nil || info.Mode().Perm() != mode {
+		t.Errorf("expected mode %v when not downloaded, got %v: %v", mode, info.Mode(), err)
+	}
+}
+
+// TestFileChecksum tests that files not having the expected checksum are
+// not written.
+func TestFileChecksum(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newServer(t, http.StatusOK, 0)
+	request := newRequest(t, server)
+	request.SHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	err := os.WriteFile(request.Destination, []byte("previous"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = download.File(t.Context(), request)
+	if !errors.Is(err, download.ErrChecksum) {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+
+	data, err := os.ReadFile(request.Destination)
+	if err != nil || string(data) != "previous" {
+		t.Errorf("destination overwritten: %q: %v", data, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(request.Destination))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("temporary file left: %v: %v", entries, err)
+	}
+}
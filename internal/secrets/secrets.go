@@ -0,0 +1,168 @@
+// Package secrets records secret values and masks them in text and streams.
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Mask is the replacement for secret values.
+const Mask = "***"
+
+// maxLineLength is the size above which a Writer stops buffering an
+// incomplete line.
+const maxLineLength = 64 * 1024
+
+// Registry records secret values to be masked.
+type Registry struct {
+	lock     sync.RWMutex
+	values   map[string]struct{}
+	replacer *strings.Replacer
+}
+
+// NewRegistry creates an empty secret values Registry.
+func NewRegistry() *Registry {
+	return &Registry{values: make(map[string]struct{})}
+}
+
+// Add records secret values. Multi-line values are also recorded line by
+// line so they are masked in line oriented output. Blank values are ignored.
+func (r *Registry) Add(values ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, value := range values {
+		for _, line := range append(strings.Split(value, "\n"), value) {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			r.values[line] = struct{}{}
+			r.replacer = nil
+		}
+	}
+}
+
+// Mask returns text with all recorded secret values replaced by Mask.
+func (r *Registry) Mask(text string) string {
+	r.lock.RLock()
+	replacer := r.replacer
+	count := len(r.values)
+	r.lock.RUnlock()
+
+	if count == 0 {
+		return text
+	}
+
+	if replacer == nil {
+		replacer = r.newReplacer()
+	}
+
+	return replacer.Replace(text)
+}
+
+func (r *Registry) newReplacer() *strings.Replacer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.replacer != nil {
+		return r.replacer
+	}
+
+	// Longest values first so that a secret containing another one is
+	// masked as a whole.
+	values := make([]string, 0, len(r.values))
+	for value := range r.values {
+		values = append(values, value)
+	}
+
+	slices.SortFunc(values, func(a, b string) int {
+		return len(b) - len(a)
+	})
+
+	oldnew := make([]string, 0, 2*len(values)) //nolint:mnd
+	for _, value := range values {
+		oldnew = append(oldnew, value, Mask)
+	}
+
+	r.replacer = strings.NewReplacer(oldnew...)
+
+	return r.replacer
+}
+
+// NewWriter returns a Writer masking recorded secret values in what is
+// written to writer.
+func (r *Registry) NewWriter(writer io.Writer) *Writer {
+	return &Writer{registry: r, out: writer}
+}
+
+// Writer is a line buffered io.Writer masking secret values.
+type Writer struct {
+	registry *Registry
+	out      io.Writer
+	lock     sync.Mutex
+	buf      []byte
+}
+
+// Write writes complete lines of data with secret values masked, buffering
+// any trailing incomplete line until more data is written or Flush is called.
+// Overly long lines are written without waiting for their end.
+func (w *Writer) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buf = append(w.buf, data...)
+
+	idx := bytes.LastIndexByte(w.buf, '\n')
+	if idx < 0 {
+		if len(w.buf) < maxLineLength {
+			return len(data), nil
+		}
+
+		idx = len(w.buf) - 1
+	}
+
+	_, err := io.WriteString(w.out, w.registry.Mask(string(w.buf[:idx+1])))
+	w.buf = slices.Delete(w.buf, 0, idx+1)
+
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return len(data), nil
+}
+
+// Flush writes any buffered incomplete line with secret values masked.
+func (w *Writer) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.out, w.registry.Mask(string(w.buf)))
+	w.buf = w.buf[:0]
+
+	return err //nolint:wrapcheck
+}
+
+var defaultRegistry = NewRegistry() //nolint:gochecknoglobals
+
+// Default returns the process wide secret values Registry.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Add records secret values in the process wide Registry.
+func Add(values ...string) {
+	defaultRegistry.Add(values...)
+}
+
+// Masked returns text with secret values of the process wide Registry masked.
+func Masked(text string) string {
+	return defaultRegistry.Mask(text)
+}
@@ -0,0 +1,70 @@
+package secrets_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stoned/tpkl/internal/secrets"
+)
+
+// TestMask tests the Registry.Mask method.
+func TestMask(t *testing.T) {
+	t.Parallel()
+
+	registry := secrets.NewRegistry()
+
+	if got := registry.Mask("nothing to mask"); got != "nothing to mask" {
+		t.Errorf("unexpected masking with an empty registry: %q", got)
+	}
+
+	registry.Add("s3cr3t", "", "  ", "s3cr3t-longer", "line1\nline2")
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{text: "no secret", expected: "no secret"},
+		{text: "token=s3cr3t", expected: "token=***"},
+		{text: "s3cr3t-longer and s3cr3t", expected: "*** and ***"},
+		{text: "a line1\nline2 b", expected: "a *** b"},
+		{text: "only line2", expected: "only ***"},
+	}
+
+	for _, testCase := range cases {
+		if diff := cmp.Diff(testCase.expected, registry.Mask(testCase.text)); diff != "" {
+			t.Errorf("Mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+// TestWriter tests the Writer type.
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	registry := secrets.NewRegistry()
+	registry.Add("s3cr3t")
+
+	buf := new(bytes.Buffer)
+	writer := registry.NewWriter(buf)
+
+	for _, chunk := range []string{"first s3c", "r3t\nsecond ", "s3cr3t\nlast s3cr3t"} {
+		_, err := writer.Write([]byte(chunk))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if diff := cmp.Diff("first ***\nsecond ***\n", buf.String()); diff != "" {
+		t.Errorf("Mismatch before flush (-want +got):\n%s", diff)
+	}
+
+	err := writer.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if diff := cmp.Diff("first ***\nsecond ***\nlast ***", buf.String()); diff != "" {
+		t.Errorf("Mismatch after flush (-want +got):\n%s", diff)
+	}
+}
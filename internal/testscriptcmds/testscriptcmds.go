@@ -2,6 +2,14 @@
 package testscriptcmds
 
 import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/rogpeppe/go-internal/testscript"
 )
 
@@ -22,3 +30,69 @@ func Empty(testScript *testscript.TestScript, neg bool, args []string) {
 		testScript.Fatalf("file %q is not empty", file)
 	}
 }
+
+// serveDelay is the delay before Serve listens, so that readiness probes
+// have to wait for it.
+const serveDelay = 200 * time.Millisecond
+
+// Serve implements a program, to be registered with testscript.Main, serving
+// `tcp` or `http` connections on an address until terminated:
+//
+//	tpkl-serve tcp|http address
+//
+// It prints `listening` once listening, after a short delay. HTTP requests
+// are answered with a 200 status.
+func Serve() {
+	if len(os.Args) != 3 { //nolint:mnd
+		fmt.Fprintln(os.Stderr, "usage: tpkl-serve tcp|http address")
+		os.Exit(2) //nolint:mnd
+	}
+
+	time.Sleep(serveDelay)
+
+	listener, err := net.Listen("tcp", os.Args[2])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("listening")
+
+	switch os.Args[1] {
+	case "http":
+		err = http.Serve(listener, http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) { //nolint:gosec
+			_, _ = io.WriteString(writer, "ok\n")
+		}))
+	default:
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+
+			_ = conn.Close()
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// SetupPorts returns a testscript setup function setting environment
+// variables to free local TCP ports.
+func SetupPorts(names ...string) func(env *testscript.Env) error {
+	return func(env *testscript.Env) error {
+		for _, name := range names {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			env.Setenv(name, strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)) //nolint:forcetypeassert
+
+			_ = listener.Close()
+		}
+
+		return nil
+	}
+}
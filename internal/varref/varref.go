@@ -0,0 +1,202 @@
+// Package varref resolves `$(NAME)` variable references, with their
+// `:-`, `:?` and `:+` operators, and parses splat words.
+package varref
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/stoned/tpkl/internal/expansion"
+)
+
+// referenceStart and referenceEnd delimit variable references.
+const (
+	referenceStart = "$("
+	referenceEnd   = ")"
+)
+
+// Operators of references with a word, applied when the variable is unset or
+// empty: `$(NAME:-default)`, `$(NAME:?message)` and `$(NAME:+alternative)`.
+const (
+	OperatorDefault     = ":-"
+	OperatorError       = ":?"
+	OperatorAlternative = ":+"
+)
+
+// defaultErrorMessage is the message of `$(NAME:?)` references errors.
+const defaultErrorMessage = "parameter null or not set"
+
+var (
+	// ErrUnset signals a `$(NAME:?message)` reference to an unset or empty variable.
+	ErrUnset = errors.New("unset or empty variable")
+	// ErrUndefined signals a reference to an undefined variable in strict expansion.
+	ErrUndefined = errors.New("undefined variable")
+	// ErrNested signals a reference in the word of a reference, which is not supported.
+	ErrNested = errors.New("nested variable reference")
+)
+
+// Reference is a variable reference: the name of a variable, optionally
+// followed by an operator and a word. Words can't contain references, e.g.
+// `$(NAME:-$(OTHER))`, since a reference ends at its first `)`.
+type Reference struct {
+	Name     string
+	Operator string
+	Word     string
+}
+
+// ParseReference parses the content of a variable reference. It returns
+// false if the content is not a variable name, optionally followed by an
+// operator and a word, e.g. a shell command substitution.
+func ParseReference(input string) (Reference, bool) {
+	ref := Reference{Name: input}
+
+	if idx := strings.IndexByte(input, ':'); idx >= 0 {
+		ref.Name = input[:idx]
+
+		for _, operator := range []string{OperatorDefault, OperatorError, OperatorAlternative} {
+			if strings.HasPrefix(input[idx:], operator) {
+				ref.Operator = operator
+				ref.Word = input[idx+len(operator):]
+
+				break
+			}
+		}
+
+		if ref.Operator == "" {
+			return ref, false
+		}
+	}
+
+	return ref, isName(ref.Name)
+}
+
+// Resolve returns the value of a reference, variables being looked up with
+// lookup, and whether it is defined.
+func (r Reference) Resolve(lookup func(string) (string, bool)) (string, bool, error) {
+	if strings.Contains(r.Word, referenceStart) {
+		return "", false, fmt.Errorf("%w: in the word of `%s`", ErrNested, r.Name)
+	}
+
+	value, ok := lookup(r.Name)
+	set := ok && value != ""
+
+	switch r.Operator {
+	case OperatorDefault:
+		if set {
+			return value, true, nil
+		}
+
+		return r.Word, true, nil
+	case OperatorError:
+		if set {
+			return value, true, nil
+		}
+
+		message := r.Word
+		if message == "" {
+			message = defaultErrorMessage
+		}
+
+		return "", false, fmt.Errorf("%w: `%s`: %s", ErrUnset, r.Name, message)
+	case OperatorAlternative:
+		if set {
+			return r.Word, true, nil
+		}
+
+		return "", true, nil
+	default:
+		return value, ok, nil
+	}
+}
+
+// ExpandLookup replaces variable references in the input string, supporting
+// operators, using lookup to resolve the values of variables. References
+// to undefined variables are left untouched, unless strict is true in which
+// case they are errors. All errors are returned, joined.
+func ExpandLookup(input string, lookup func(string) (string, bool), strict bool) (string, error) {
+	var errs []error
+
+	output := expansion.Expand(input, func(content string) string {
+		ref, ok := ParseReference(content)
+		if !ok {
+			return referenceStart + content + referenceEnd
+		}
+
+		value, defined, err := ref.Resolve(lookup)
+
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case !defined && strict:
+			errs = append(errs, fmt.Errorf("%w: `%s`", ErrUndefined, ref.Name))
+		case defined:
+			return value
+		}
+
+		return referenceStart + content + referenceEnd
+	})
+
+	return output, errors.Join(errs...)
+}
+
+// UndefinedReferences returns the names of the undefined variables, according
+// to lookup, referenced without operator in the input string.
+func UndefinedReferences(input string, lookup func(string) (string, bool)) []string {
+	var names []string
+
+	expansion.Expand(input, func(content string) string {
+		ref, ok := ParseReference(content)
+		if ok && ref.Operator == "" {
+			if _, defined := lookup(ref.Name); !defined {
+				names = append(names, ref.Name)
+			}
+		}
+
+		return ""
+	})
+
+	return names
+}
+
+func isName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, char := range name {
+		if char != '_' && (char < '0' || char > '9') && (char < 'a' || char > 'z') && (char < 'A' || char > 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splatSuffix ends the variable name of a splat word.
+const splatSuffix = "..."
+
+// SplatArgs is the name of the splat word of task arguments, `$(@)`.
+const SplatArgs = "@"
+
+// ParseSplat returns the name of the variable of a splat word, a word that
+// is exactly `$(@)` or `$(NAME...)`, expanding into zero or more words.
+func ParseSplat(word string) (string, bool) {
+	content, found := strings.CutPrefix(word, referenceStart)
+	if !found {
+		return "", false
+	}
+
+	content, found = strings.CutSuffix(content, referenceEnd)
+	if !found {
+		return "", false
+	}
+
+	if content == SplatArgs {
+		return content, true
+	}
+
+	name, found := strings.CutSuffix(content, splatSuffix)
+
+	return name, found && isName(name)
+}
@@ -0,0 +1,149 @@
+package varref_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stoned/tpkl/internal/varref"
+)
+
+func testLookup(name string) (string, bool) {
+	vars := map[string]string{
+		"VAR_A":     "A",
+		"VAR_EMPTY": "",
+	}
+
+	value, ok := vars[name]
+
+	return value, ok
+}
+
+func TestExpandLookup(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "defined", input: "$(VAR_A)", expected: "A"},
+		{name: "undefined", input: "$(VAR_NOT_THERE)", expected: "$(VAR_NOT_THERE)"},
+		{name: "default of set", input: "$(VAR_A:-dflt)", expected: "A"},
+		{name: "default of empty", input: "$(VAR_EMPTY:-dflt)", expected: "dflt"},
+		{name: "default of undefined", input: "$(VAR_NOT_THERE:-dflt)", expected: "dflt"},
+		{name: "empty default", input: "<$(VAR_NOT_THERE:-)>", expected: "<>"},
+		{name: "error of set", input: "$(VAR_A:?message)", expected: "A"},
+		{name: "alternative of set", input: "$(VAR_A:+alt)", expected: "alt"},
+		{name: "alternative of empty", input: "<$(VAR_EMPTY:+alt)>", expected: "<>"},
+		{name: "alternative of undefined", input: "<$(VAR_NOT_THERE:+alt)>", expected: "<>"},
+		{name: "escaped", input: "$$(VAR_A:-dflt)", expected: "$(VAR_A:-dflt)"},
+		{name: "unknown operator", input: "$(VAR_A:=dflt)", expected: "$(VAR_A:=dflt)"},
+		{name: "command substitution", input: `$(cat "${VAR_A}")`, expected: `$(cat "${VAR_A}")`},
+	}
+
+	for _, testCase := range cases {
+		for _, strict := range []bool{false, true} {
+			if strict && testCase.name == "undefined" {
+				continue
+			}
+
+			got, err := varref.ExpandLookup(testCase.input, testLookup, strict)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", testCase.name, err)
+			}
+
+			if got != testCase.expected {
+				t.Errorf("%s: expected %q, got %q", testCase.name, testCase.expected, got)
+			}
+		}
+	}
+}
+
+func TestExpandLookupErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		input    string
+		strict   bool
+		err      error
+		expected string
+	}{
+		{
+			name:     "error of empty",
+			input:    "$(VAR_EMPTY:?is empty)",
+			err:      varref.ErrUnset,
+			expected: "unset or empty variable: `VAR_EMPTY`: is empty",
+		},
+		{
+			name:     "error of undefined",
+			input:    "$(VAR_NOT_THERE:?)",
+			err:      varref.ErrUnset,
+			expected: "unset or empty variable: `VAR_NOT_THERE`: parameter null or not set",
+		},
+		{
+			name:     "nested",
+			input:    "$(VAR_NOT_THERE:-$(VAR_A))",
+			err:      varref.ErrNested,
+			expected: "nested variable reference: in the word of `VAR_NOT_THERE`",
+		},
+		{
+			name:     "strict undefined",
+			input:    "$(VAR_A) $(VRESION) $(VAR_NOT_THERE)",
+			strict:   true,
+			err:      varref.ErrUndefined,
+			expected: "undefined variable: `VRESION`\nundefined variable: `VAR_NOT_THERE`",
+		},
+	}
+
+	for _, testCase := range cases {
+		_, err := varref.ExpandLookup(testCase.input, testLookup, testCase.strict)
+		if !errors.Is(err, testCase.err) {
+			t.Fatalf("%s: expected error %q, got %v", testCase.name, testCase.err, err)
+		}
+
+		if err.Error() != testCase.expected {
+			t.Errorf("%s: expected error message %q, got %q", testCase.name, testCase.expected, err)
+		}
+	}
+}
+
+func TestUndefinedReferences(t *testing.T) {
+	t.Parallel()
+
+	input := "$(VAR_A) $(VRESION) $(VAR_NOT_THERE:-dflt) $$(ESCAPED) $(date) $(cat file)"
+	expected := []string{"VRESION", "date"}
+
+	got := varref.UndefinedReferences(input, testLookup)
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestParseSplat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		word     string
+		name     string
+		expected bool
+	}{
+		{word: "$(@)", name: "@", expected: true},
+		{word: "$(TPKL_TASK_ARGS...)", name: "TPKL_TASK_ARGS", expected: true},
+		{word: "$(LIST...)", name: "LIST", expected: true},
+		{word: "$(LIST)", expected: false},
+		{word: "$(...)", expected: false},
+		{word: "-$(LIST...)", expected: false},
+		{word: "$(LIST...)-", expected: false},
+		{word: "$$(LIST...)", expected: false},
+		{word: "$(@...)", expected: false},
+	}
+
+	for _, testCase := range cases {
+		name, ok := varref.ParseSplat(testCase.word)
+		if ok != testCase.expected || (ok && name != testCase.name) {
+			t.Errorf("%q: expected %q, %t, got %q, %t", testCase.word, testCase.name, testCase.expected, name, ok)
+		}
+	}
+}
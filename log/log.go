@@ -2,8 +2,11 @@
 package log
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -13,6 +16,7 @@ import (
 	"github.com/go-logfmt/logfmt"
 	"github.com/mgutz/ansi"
 	"github.com/rs/zerolog"
+	"github.com/stoned/tpkl/internal/secrets"
 	"golang.org/x/term"
 )
 
@@ -85,23 +89,84 @@ func builder(cmd string, verbosity int) func() zerolog.Logger {
 		// https://github.com/rs/zerolog/issues/114
 		zerolog.TimeFieldFormat = time.RFC3339Nano
 
-		loggerOut := zerolog.NewConsoleWriter(
-			func(writer *zerolog.ConsoleWriter) {
-				writer.PartsOrder = logPartsOrder()
-				writer.TimeFormat = "15:04:05.000"
-				writer.FormatPartValueByName = getFormatPartValueByName(noColor)
-				writer.FieldsExclude = []string{"call", "cmd", "shell", "task", "tpkl"}
-				writer.FieldsOrder = []string{"cur"}
-				writer.NoColor = noColor
-				writer.Out = os.Stderr
-			},
-		)
-		logger := zerolog.New(loggerOut).Level(level).With().Timestamp().Str("tpkl", cmd).Logger()
+		logger := zerolog.New(newConsoleWriter(os.Stderr, noColor)).Level(level).With().Timestamp().
+			Str("tpkl", cmd).Logger()
 
 		return logger
 	}
 }
 
+// newConsoleWriter returns the writer formatting log events for the console
+// to out. Secret values are masked in the events, before their values are
+// escaped, and in the formatted output.
+func newConsoleWriter(out io.Writer, noColor bool) io.Writer {
+	consoleWriter := zerolog.NewConsoleWriter(
+		func(writer *zerolog.ConsoleWriter) {
+			writer.PartsOrder = logPartsOrder()
+			writer.TimeFormat = "15:04:05.000"
+			writer.FormatPartValueByName = getFormatPartValueByName(noColor)
+			writer.FieldsExclude = []string{"call", "cmd", "shell", "task", "tpkl"}
+			writer.FieldsOrder = []string{"cur"}
+			writer.NoColor = noColor
+			writer.Out = secrets.Default().NewWriter(out)
+		},
+	)
+
+	return maskingWriter{out: consoleWriter}
+}
+
+// maskingWriter masks secret values in the string values of the JSON log
+// events written to out, so that they are masked whatever the escaping of
+// their formatting.
+type maskingWriter struct {
+	out io.Writer
+}
+
+// Write writes a JSON log event with secret values masked, or unchanged if
+// it can't be decoded.
+func (w maskingWriter) Write(data []byte) (int, error) {
+	var event map[string]any
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&event)
+	if err != nil {
+		return w.out.Write(data) //nolint:wrapcheck
+	}
+
+	masked, err := json.Marshal(maskValues(event))
+	if err != nil {
+		return w.out.Write(data) //nolint:wrapcheck
+	}
+
+	_, err = w.out.Write(append(masked, '\n'))
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return len(data), nil
+}
+
+// maskValues returns a decoded JSON value with secret values masked in its
+// strings.
+func maskValues(value any) any {
+	switch value := value.(type) {
+	case string:
+		return secrets.Masked(value)
+	case []any:
+		for idx, item := range value {
+			value[idx] = maskValues(item)
+		}
+	case map[string]any:
+		for key, item := range value {
+			value[key] = maskValues(item)
+		}
+	}
+
+	return value
+}
+
 // AsFatal generate a Fatal-like log with a message.
 func AsFatal(logger *zerolog.Logger, msg string) {
 	logger.WithLevel(zerolog.FatalLevel).Msg(msg)
@@ -153,6 +218,15 @@ func DebugShell(ctx context.Context, command []string) {
 	}
 }
 
+// TraceShell log at trace level, whatever the logger level, a simple
+// command executed by the embedded shell, after expansion, with the line
+// number of its script.
+func TraceShell(ctx context.Context, line uint, command string) {
+	logger := FromContext(ctx).Level(zerolog.TraceLevel)
+
+	logger.Trace().Uint("line", line).Msg("+ " + command)
+}
+
 func logPartsOrder() []string {
 	return []string{
 		zerolog.TimestampFieldName,
@@ -0,0 +1,36 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stoned/tpkl/internal/secrets"
+)
+
+// TestConsoleWriterMasksSecrets tests that secret values are masked in log
+// fields and messages even when they contain characters escaped by the
+// formatting.
+func TestConsoleWriterMasksSecrets(t *testing.T) {
+	t.Parallel()
+
+	secret := "tpkl-log-\"s3cr3t\\\nline"
+	secrets.Add(secret)
+
+	var out bytes.Buffer
+
+	logger := zerolog.New(newConsoleWriter(&out, true))
+	logger.Info().Str("value", secret).Strs("values", []string{secret}).Str("cmd", secret).Msg(secret)
+
+	output := out.String()
+	for _, leak := range []string{"s3cr3t", "tpkl-log"} {
+		if strings.Contains(output, leak) {
+			t.Errorf("secret leaked in %q", output)
+		}
+	}
+
+	if !strings.Contains(output, "value="+secrets.Mask) {
+		t.Errorf("secret not masked in %q", output)
+	}
+}
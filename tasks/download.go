@@ -0,0 +1,79 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/stoned/tpkl/internal/download"
+	"github.com/stoned/tpkl/log"
+	"github.com/stoned/tpkl/modules/tpkl"
+)
+
+// expandDownload returns a copy of a download whose url, destination,
+// checksum and header values are expanded.
+func expandDownload(definition tpkl.Download, expand func(string) (string, error)) (*tpkl.Download, error) {
+	var errs []error
+
+	expandField := func(value string) string {
+		expanded, err := expand(value)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		return expanded
+	}
+
+	expanded := definition
+	expanded.Url = expandField(definition.Url)
+	expanded.Destination = expandField(definition.Destination)
+	expanded.Sha256 = expandField(definition.Sha256)
+	expanded.Headers = make(map[string]string, len(definition.Headers))
+
+	for name, value := range definition.Headers {
+		expanded.Headers[name] = expandField(value)
+	}
+
+	return &expanded, errors.Join(errs...)
+}
+
+// runDownload downloads a file, its destination being relative to dir, unless
+// it already has the expected checksum.
+func runDownload(ctx context.Context, definition *tpkl.Download, dir string) error {
+	destination := definition.Destination
+	if !filepath.IsAbs(destination) {
+		destination = filepath.Join(dir, destination)
+	}
+
+	err := os.MkdirAll(filepath.Dir(destination), fileOperationDirMode)
+	if err != nil {
+		return NewCmdError(1, fmt.Errorf("%w: %w", ErrDownload, err))
+	}
+
+	request := download.Request{
+		URL:         definition.Url,
+		Destination: destination,
+		SHA256:      definition.Sha256,
+		Headers:     definition.Headers,
+		Retries:     definition.Retries,
+	}
+
+	if definition.Mode != nil {
+		mode := fs.FileMode(*definition.Mode) //nolint:gosec
+		request.Mode = &mode
+	}
+
+	downloaded, err := download.File(ctx, request)
+	if err != nil {
+		return NewCmdError(1, fmt.Errorf("%w: %s: %w", ErrDownload, definition.Url, err))
+	}
+
+	if !downloaded {
+		log.FromContext(ctx).Info().Str("destination", destination).Msg("download skipped, checksum matches")
+	}
+
+	return nil
+}
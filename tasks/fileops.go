@@ -0,0 +1,244 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/stoned/tpkl/internal/coreutils"
+	"github.com/stoned/tpkl/modules/tpkl"
+)
+
+// Default permissions of the files and directories created by file
+// operations, before the umask.
+const (
+	fileOperationFileMode fs.FileMode = 0o666
+	fileOperationDirMode  fs.FileMode = 0o777
+)
+
+// expandFileOperation returns a copy of a file operation whose paths, and
+// content if requested, are expanded.
+func expandFileOperation(operation tpkl.FileOperation, expand func(string) (string, error)) (*tpkl.FileOperation,
+	error,
+) {
+	var errs []error
+
+	expandField := func(value string) string {
+		expanded, err := expand(value)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		return expanded
+	}
+
+	expanded := operation
+	expanded.Paths = make([]string, len(operation.Paths))
+
+	for idx, path := range operation.Paths {
+		expanded.Paths[idx] = expandField(path)
+	}
+
+	if operation.Destination != nil {
+		destination := expandField(*operation.Destination)
+		expanded.Destination = &destination
+	}
+
+	if operation.Content != nil && operation.Expand {
+		content := expandField(*operation.Content)
+		expanded.Content = &content
+	}
+
+	return &expanded, errors.Join(errs...)
+}
+
+// displayFileOperation returns a short representation of a file operation.
+func displayFileOperation(operation *tpkl.FileOperation) string {
+	words := append([]string{operation.Operation}, operation.Paths...)
+	if operation.Destination != nil {
+		words = append(words, *operation.Destination)
+	}
+
+	return displayCommand(words)
+}
+
+// runFileOperation runs a file operation, relative paths being relative to dir.
+func runFileOperation(operation *tpkl.FileOperation, dir string) error {
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return filepath.Clean(path)
+		}
+
+		return filepath.Join(dir, path)
+	}
+
+	fileMode, dirMode := fileOperationFileMode, fileOperationDirMode
+	if operation.Mode != nil {
+		fileMode, dirMode = fs.FileMode(*operation.Mode), fs.FileMode(*operation.Mode) //nolint:gosec
+	}
+
+	var destination string
+	if operation.Destination != nil {
+		destination = resolve(*operation.Destination)
+
+		err := os.MkdirAll(filepath.Dir(destination), fileOperationDirMode)
+		if err != nil {
+			return NewCmdError(1, fmt.Errorf("%w: %w", ErrFileOperation, err))
+		}
+	}
+
+	var err error
+
+	switch operation.Operation {
+	case "copy":
+		err = copyFiles(operation.Paths, destination, resolve, operation.Mode != nil, fileMode)
+	case "mkdir":
+		for _, path := range operation.Paths {
+			err = errors.Join(err, os.MkdirAll(resolve(path), dirMode))
+		}
+	case "remove":
+		err = removeFiles(operation.Paths, dir, resolve)
+	case "symlink":
+		err = symlinkFile(operation.Paths[0], destination)
+	case "writeFile":
+		err = os.WriteFile(destination, []byte(*operation.Content), fileMode)
+		if err == nil && operation.Mode != nil {
+			err = os.Chmod(destination, fileMode)
+		}
+	default:
+		return NewCmdError(1, fmt.Errorf("%w: unknown operation `%s`", ErrFileOperation, operation.Operation))
+	}
+
+	if err != nil {
+		return NewCmdError(1, fmt.Errorf("%w: %s: %w", ErrFileOperation, operation.Operation, err))
+	}
+
+	return nil
+}
+
+// copyFiles copies the files matching glob patterns, recursively, to dest,
+// into it if it is a directory or if there are several files. The copies get
+// mode if chmod is true.
+func copyFiles(patterns []string, dest string, resolve func(string) string, chmod bool, mode fs.FileMode) error {
+	var sources []string
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(resolve(pattern))
+		if err != nil {
+			return fmt.Errorf("`%s`: %w", pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return fmt.Errorf("`%s`: %w", pattern, fs.ErrNotExist)
+		}
+
+		sources = append(sources, matches...)
+	}
+
+	info, err := os.Stat(dest)
+	intoDir := err == nil && info.IsDir()
+
+	if len(sources) > 1 && !intoDir {
+		err = os.MkdirAll(dest, fileOperationDirMode)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		intoDir = true
+	}
+
+	var errs []error
+
+	for _, source := range sources {
+		target := dest
+		if intoDir {
+			target = filepath.Join(dest, filepath.Base(source))
+		}
+
+		err = coreutils.CopyPath(source, target)
+		if err == nil && chmod {
+			err = chmodTree(target, mode)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("`%s`: %w", source, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// chmodTree changes the mode of a file or, recursively, of a directory tree,
+// but not of the symbolic links it contains. Directories are changed after
+// their content, so that mode can't prevent walking them.
+func chmodTree(root string, mode fs.FileMode) error {
+	var paths []string
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type()&fs.ModeSymlink == 0 {
+			paths = append(paths, path)
+		}
+
+		return err
+	})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	for _, path := range slices.Backward(paths) {
+		err = os.Chmod(path, mode)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+
+	return nil
+}
+
+// removeFiles removes the files matching glob patterns, recursively. It
+// refuses to remove dir, one of its parents or the root directory.
+func removeFiles(patterns []string, dir string, resolve func(string) string) error {
+	var errs []error
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(resolve(pattern))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("`%s`: %w", pattern, err))
+
+			continue
+		}
+
+		for _, path := range matches {
+			rel, err := filepath.Rel(path, dir)
+			if (err == nil && filepath.IsLocal(rel)) || filepath.Dir(path) == path {
+				errs = append(errs, fmt.Errorf("%w on `%s`", coreutils.ErrRefused, path))
+
+				continue
+			}
+
+			err = os.RemoveAll(path)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// symlinkFile creates link as a symbolic link to target, replacing link if
+// it is already a symbolic link.
+func symlinkFile(target string, link string) error {
+	info, err := os.Lstat(link)
+	if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		err = os.Remove(link)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+
+	return os.Symlink(target, link) //nolint:wrapcheck
+}
@@ -0,0 +1,636 @@
+package tasks
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/stoned/tpkl/internal/secrets"
+	"github.com/stoned/tpkl/log"
+	"github.com/stoned/tpkl/modules/tpkl"
+	"golang.org/x/tools/txtar"
+)
+
+const (
+	// fileDefaultMode is the mode of task files created from their content.
+	fileDefaultMode os.FileMode = 0o666
+	// dirDefaultMode is the mode of the task files parent directories.
+	dirDefaultMode os.FileMode = 0o750
+	// secretFileMode is the default mode of secret task files.
+	secretFileMode os.FileMode = 0o600
+	// secretDirMode is the mode of the secret task files parent directories.
+	secretDirMode os.FileMode = 0o700
+	// ownerOnlyMask masks out group and other permissions.
+	ownerOnlyMask os.FileMode = 0o700
+	// shredBufferSize is the size of writes overwriting secret files.
+	shredBufferSize = 32 * 1024
+	// fileScopeRun is the scope of files shared by all calls of a task.
+	fileScopeRun = "run"
+)
+
+type taskFile struct {
+	Path    string
+	Varname *string
+	Secret  bool
+}
+type taskFiles struct {
+	Dir       string
+	Files     map[string]taskFile
+	defs      map[string]tpkl.File
+	keep      string
+	released  bool
+	lock      sync.Mutex
+	writeOnce sync.Once
+	writeErr  error
+}
+
+// newTaskFiles creates a new temporary directory and sets the paths of files
+// in it. They are released, according to the keep policy, upon termination
+// signals.
+func newTaskFiles(ctx context.Context, files map[string]tpkl.File, keep string,
+	termChannel chan any, termWaitGroup *sync.WaitGroup,
+) (*taskFiles, error) {
+	tfiles := taskFiles{Files: make(map[string]taskFile), defs: files, keep: keep}
+
+	if len(files) == 0 {
+		return &tfiles, nil
+	}
+
+	tempDirs := []string{os.TempDir()}
+	if hasSecretFile(files) {
+		tempDirs = append([]string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"}, tempDirs...)
+	}
+
+	dir, err := mkdirTemp(tempDirs, "tpkl_taskfiles_*")
+	if err != nil {
+		return nil, fmt.Errorf("%w: error creating temporary directory: %w", ErrTaskFile, err)
+	}
+
+	termWaitGroup.Add(1)
+
+	tfiles.Dir = dir
+
+	go func() {
+		defer termWaitGroup.Done()
+
+		<-termChannel
+
+		tfiles.release(ctx, true)
+	}()
+
+	for key, file := range files {
+		var filename string
+
+		if file.Filename != nil {
+			filename = *file.Filename
+		} else {
+			filename = key
+		}
+
+		if !filepath.IsLocal(filename) {
+			return &tfiles, fmt.Errorf("%w: `%s`: filename is not a local relative path: %q", ErrTaskFile, key, filename)
+		}
+
+		path := filepath.Join(tfiles.Dir, filename)
+
+		tfiles.lock.Lock()
+		tfiles.Files[key] = taskFile{Path: path, Varname: file.Varname, Secret: file.Secret}
+		tfiles.lock.Unlock()
+	}
+
+	return &tfiles, nil
+}
+
+// write writes files, once, expanding variable references in the content
+// of files to expand.
+func (tf *taskFiles) write(moduleDir string, expand func(string) (string, error)) error {
+	tf.writeOnce.Do(func() {
+		for key, file := range tf.defs {
+			if file.Expand && file.Content != nil {
+				content, err := expand(*file.Content)
+				if err != nil {
+					tf.writeErr = fmt.Errorf("%w: `%s`: %w", ErrTaskFile, key, err)
+
+					return
+				}
+
+				file.Content = &content
+			}
+
+			tf.writeErr = writeTaskFile(tf.Files[key].Path, file, moduleDir)
+			if tf.writeErr != nil {
+				return
+			}
+		}
+	})
+
+	return tf.writeErr
+}
+
+// taskFilesDefinitions returns the files of a task, including the members of
+// its txtar archives.
+func taskFilesDefinitions(task tpkl.Task, moduleDir string) (map[string]tpkl.File, error) {
+	archives := task.GetFilesArchives()
+	if len(archives) == 0 {
+		return task.GetFiles(), nil
+	}
+
+	files := maps.Clone(task.GetFiles())
+	if files == nil {
+		files = make(map[string]tpkl.File)
+	}
+
+	for _, archive := range archives {
+		members, err := readFilesArchive(archive, moduleDir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members.Files {
+			key := archiveMemberKey(member.Name)
+			if _, ok := files[key]; ok {
+				return nil, fmt.Errorf("%w: archive member %q: duplicate key `%s`", ErrTaskFile, member.Name, key)
+			}
+
+			content := string(member.Data)
+			files[key] = tpkl.File{
+				Content:  &content,
+				Filename: &member.Name,
+				Expand:   archive.Expand,
+				Secret:   archive.Secret,
+				Scope:    archive.Scope,
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// readFilesArchive parses a txtar archive from its content or its source, a
+// file relative to the module directory.
+func readFilesArchive(archive tpkl.FilesArchive, moduleDir string) (*txtar.Archive, error) {
+	if archive.Content != nil {
+		return txtar.Parse([]byte(*archive.Content)), nil
+	}
+
+	if archive.Source == nil {
+		return &txtar.Archive{}, nil
+	}
+
+	source := *archive.Source
+	if !filepath.IsAbs(source) {
+		source = filepath.Join(moduleDir, source)
+	}
+
+	data, err := os.ReadFile(source) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading archive: %w", ErrTaskFile, err)
+	}
+
+	return txtar.Parse(data), nil
+}
+
+// archiveMemberKey returns the task file key of an archive member, its name
+// with characters other than letters, digits and `_` replaced by `_`.
+func archiveMemberKey(name string) string {
+	return strings.Map(func(char rune) rune {
+		if unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_' {
+			return char
+		}
+
+		return '_'
+	}, name)
+}
+
+// filesByScope splits files between task scoped and run scoped ones.
+func filesByScope(files map[string]tpkl.File) (map[string]tpkl.File, map[string]tpkl.File) {
+	taskScoped := make(map[string]tpkl.File)
+	runScoped := make(map[string]tpkl.File)
+
+	for key, file := range files {
+		if file.Scope == fileScopeRun {
+			runScoped[key] = file
+		} else {
+			taskScoped[key] = file
+		}
+	}
+
+	return taskScoped, runScoped
+}
+
+// keepFilesPolicy returns the policy keeping files the most often.
+func keepFilesPolicy(policies ...string) string {
+	rank := map[string]int{KeepFilesNever: 0, KeepFilesOnFailure: 1, KeepFilesAlways: 2} //nolint:mnd
+	policy := KeepFilesNever
+
+	for _, p := range policies {
+		if rank[p] > rank[policy] {
+			policy = p
+		}
+	}
+
+	return policy
+}
+
+// hasSecretFile tells if some of the files are secret.
+func hasSecretFile(files map[string]tpkl.File) bool {
+	for _, file := range files {
+		if file.Secret {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mkdirTemp creates a new temporary directory in the first of the given
+// directories where it is possible.
+func mkdirTemp(dirs []string, pattern string) (string, error) {
+	var errs []error
+
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		tempDir, err := os.MkdirTemp(dir, pattern)
+		if err == nil {
+			return tempDir, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return "", errors.Join(errs...)
+}
+
+// writeTaskFile creates a task file, or directory, at path from its content,
+// its base64 encoded content, or the file or directory it is a copy of.
+// Secret files are only accessible by their owner and their content, decoded
+// or read from their source, is recorded as a secret to be masked.
+func writeTaskFile(path string, file tpkl.File, moduleDir string) error {
+	var err error
+
+	mode, dirMode := fileDefaultMode, dirDefaultMode
+	if file.Secret {
+		mode, dirMode = secretFileMode, secretDirMode
+
+		if file.Content != nil {
+			secrets.Add(*file.Content)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), dirMode)
+	if err != nil {
+		return fmt.Errorf("%w: creating directory: %w", ErrTaskFile, err)
+	}
+
+	switch {
+	case file.Source != nil:
+		mode, err = copyTaskFileSource(path, *file.Source, moduleDir, file.Secret)
+	case file.Base64 != nil:
+		var data []byte
+
+		data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(*file.Base64), ""))
+		if err != nil {
+			return fmt.Errorf("%w: decoding base64 content of %q: %w", ErrTaskFile, path, err)
+		}
+
+		if file.Secret {
+			secrets.Add(string(data))
+		}
+
+		err = writeFile(path, data, mode)
+	case file.Content != nil:
+		err = writeFile(path, []byte(*file.Content), mode)
+	default:
+		err = writeFile(path, nil, mode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if file.Mode != nil {
+		mode = os.FileMode(*file.Mode) //nolint:gosec
+	} else if mode == fileDefaultMode {
+		return nil
+	}
+
+	if file.Secret {
+		mode &= ownerOnlyMask
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return fmt.Errorf("%w: changing mode of %q: %w", ErrTaskFile, path, err)
+	}
+
+	return nil
+}
+
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	tmpfile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode) // #nosec G304
+	if err != nil {
+		return fmt.Errorf("%w: creating temporary file: %q: %w", ErrTaskFile, path, err)
+	}
+
+	_, err = tmpfile.Write(data)
+	if err != nil {
+		_ = tmpfile.Close()
+
+		return fmt.Errorf("%w: writing to temporary file: %q: %w", ErrTaskFile, path, err)
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return fmt.Errorf("%w: closing temporary file: %q: %w", ErrTaskFile, path, err)
+	}
+
+	return nil
+}
+
+// copyTaskFileSource copies a file or a directory tree, relative to the
+// module directory, to path and returns its permissions. The permissions of
+// a secret copy are restricted to its owner and its content is recorded as a
+// secret to be masked.
+func copyTaskFileSource(path string, source string, moduleDir string, secret bool) (os.FileMode, error) {
+	if !filepath.IsAbs(source) {
+		source = filepath.Join(moduleDir, source)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return 0, fmt.Errorf("%w: source of %q: %w", ErrTaskFile, path, err)
+	}
+
+	if info.IsDir() {
+		err = os.CopyFS(path, os.DirFS(source))
+		if err != nil {
+			return 0, fmt.Errorf("%w: copying directory %q to %q: %w", ErrTaskFile, source, path, err)
+		}
+
+		if secret {
+			err = restrictTree(path)
+			if err != nil {
+				return 0, fmt.Errorf("%w: restricting permissions of %q: %w", ErrTaskFile, path, err)
+			}
+
+			err = addSecretTree(path)
+			if err != nil {
+				return 0, fmt.Errorf("%w: reading secret files of %q: %w", ErrTaskFile, path, err)
+			}
+		}
+
+		return info.Mode().Perm(), nil
+	}
+
+	data, err := os.ReadFile(source) // #nosec G304
+	if err != nil {
+		return 0, fmt.Errorf("%w: source of %q: %w", ErrTaskFile, path, err)
+	}
+
+	mode := info.Mode().Perm()
+	if secret {
+		mode &= ownerOnlyMask
+
+		secrets.Add(string(data))
+	}
+
+	return mode, writeFile(path, data, mode)
+}
+
+// restrictTree restricts permissions of a directory tree to its owner.
+func restrictTree(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error { //nolint:wrapcheck
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		return os.Chmod(path, info.Mode().Perm()&ownerOnlyMask) //nolint:wrapcheck
+	})
+}
+
+// addSecretTree records the content of the regular files of a directory tree
+// as secrets to be masked.
+func addSecretTree(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error { //nolint:wrapcheck
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		data, err := os.ReadFile(path) // #nosec G304
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		secrets.Add(string(data))
+
+		return nil
+	})
+}
+
+// shred overwrites with zeros the regular files of a directory tree.
+func shred(root string) error {
+	zeros := make([]byte, shredBufferSize)
+
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error { //nolint:wrapcheck
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		_ = os.Chmod(path, secretFileMode)
+
+		file, err := os.OpenFile(path, os.O_WRONLY, 0) // #nosec G304
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		for remaining := info.Size(); remaining > 0 && err == nil; {
+			var written int
+
+			written, err = file.Write(zeros[:min(remaining, int64(len(zeros)))])
+			remaining -= int64(written)
+		}
+
+		if err == nil {
+			err = file.Sync()
+		}
+
+		return errors.Join(err, file.Close())
+	})
+}
+
+// release removes task files unless the keep policy tells to keep them,
+// in which case their location is logged. Secret files are never kept.
+func (tf *taskFiles) release(ctx context.Context, failed bool) {
+	logger := log.FromContext(ctx)
+
+	if tf.keep == KeepFilesAlways || (failed && tf.keep == KeepFilesOnFailure) {
+		tf.lock.Lock()
+		defer tf.lock.Unlock()
+
+		if len(tf.Dir) != 0 && !tf.released {
+			err := errors.Join(tf.removeSecretFiles()...)
+			if err != nil {
+				logger.Warn().Err(err).Msg("cleaning up secret task files")
+			}
+
+			logger.Warn().Str("dir", tf.Dir).Msg("keeping task files")
+		}
+
+		tf.released = true
+
+		return
+	}
+
+	err := tf.cleanup()
+	if err != nil {
+		logger.Warn().Err(err).Msg("cleaning up task files")
+	}
+}
+
+// cleanup removes task files, secret ones being overwritten beforehand.
+func (tf *taskFiles) cleanup() error {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	if len(tf.Dir) == 0 || tf.released {
+		return nil
+	}
+
+	tf.released = true
+
+	errs := tf.removeSecretFiles()
+
+	err := os.RemoveAll(tf.Dir)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%w: removing temporary directory: %s: %w", ErrTaskFile, tf.Dir, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeSecretFiles overwrites and removes secret task files.
+func (tf *taskFiles) removeSecretFiles() []error {
+	var errs []error
+
+	for _, file := range tf.Files {
+		if !file.Secret {
+			continue
+		}
+
+		err := shred(file.Path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: overwriting secret file: %s: %w", ErrTaskFile, file.Path, err))
+
+			continue
+		}
+
+		err = os.RemoveAll(file.Path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: removing secret file: %s: %w", ErrTaskFile, file.Path, err))
+		}
+	}
+
+	return errs
+}
+
+// filesDirs returns the directories of the sets of files having some.
+func filesDirs(filesSets ...*taskFiles) []string {
+	var dirs []string
+
+	for _, files := range filesSets {
+		if len(files.Dir) != 0 && len(files.Files) != 0 {
+			dirs = append(dirs, files.Dir)
+		}
+	}
+
+	return dirs
+}
+
+// Set variables relative to task files in a frame. TPKL_FILES_DIR is the
+// directory of the task scoped files and TPKL_RUN_FILES_DIR the one of the
+// run scoped files, when there are some.
+func (f *Frame) setTaskFilesVars(tfiles *taskFiles, runFiles *taskFiles) error {
+	var (
+		err                            error
+		fileIndex, enclosingFilesCount int
+	)
+
+	// Get TPKL_FILES_COUNT from enclosing frame if any
+	if f.enclosing != nil {
+		enclosingVars := f.enclosing.Merge()
+		name := prefixedVarName(filesCountVarNameSuffix)
+
+		if value, ok := enclosingVars[name]; ok {
+			enclosingFilesCount, err = strconv.Atoi(value)
+			if err == nil {
+				fileIndex = enclosingFilesCount
+			} else {
+				return fmt.Errorf("%w: converting environment variable `%s` value to integer: %w", ErrTaskFile, name, err)
+			}
+		}
+	}
+
+	filesSets := []*taskFiles{tfiles, runFiles}
+
+	filesCount := 0
+	for _, files := range filesSets {
+		filesCount += len(files.Files)
+	}
+
+	// Set TPKL_FILES_COUNT for this frame.
+	f.setPrefixedVar(filesCountVarNameSuffix, strconv.Itoa(enclosingFilesCount+filesCount))
+
+	if len(tfiles.Dir) != 0 && len(tfiles.Files) != 0 {
+		f.setPrefixedVar(filesDirVarNameSuffix, tfiles.Dir)
+	}
+
+	if len(runFiles.Dir) != 0 && len(runFiles.Files) != 0 {
+		f.setPrefixedVar(runFilesDirVarNameSuffix, runFiles.Dir)
+	}
+
+	for _, files := range filesSets {
+		for key, file := range files.Files {
+			f.setPrefixedVar("FILE_"+key, file.Path)
+			f.setPrefixedVar("FILES_KEY_"+strconv.Itoa(fileIndex), key)
+			f.setPrefixedVar("FILES_PATH_"+strconv.Itoa(fileIndex), file.Path)
+
+			if file.Varname != nil {
+				f.SetVar(*file.Varname, file.Path)
+			}
+
+			fileIndex++
+		}
+	}
+
+	return nil
+}
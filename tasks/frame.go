@@ -1,10 +1,17 @@
 package tasks
 
 import (
+	"errors"
+	"fmt"
 	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/stoned/tpkl/internal/varref"
 )
 
 // Frame represent a task's environment.
@@ -14,6 +21,11 @@ type Frame struct {
 	enclosing *Frame
 	merged    map[string]string
 	lock      sync.Mutex
+	// environPatterns restrict the environment variables accessible from the
+	// frame, including the ones inherited from the enclosing frame, when
+	// environFiltered is true.
+	environPatterns []string
+	environFiltered bool
 }
 
 // NewFrame creates an empty task Frame.
@@ -38,6 +50,33 @@ func (frame *Frame) SetEnviron() {
 	defer frame.lock.Unlock()
 
 	frame.environ = GetEnviron()
+	frame.environPatterns = nil
+	frame.environFiltered = false
+	frame.merged = nil
+}
+
+// SetEnvironMatching provides access to the environment variables whose name
+// matches one of the given patterns, using filepath.Match syntax, none without
+// patterns. Environment variables inherited from the enclosing frame are
+// filtered the same way, unlike the variables set in enclosing frames.
+func (frame *Frame) SetEnvironMatching(patterns []string) {
+	frame.lock.Lock()
+	defer frame.lock.Unlock()
+
+	frame.environ = make(map[string]string)
+	frame.environPatterns = patterns
+	frame.environFiltered = true
+
+	for name, val := range GetEnviron() {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				frame.environ[name] = val
+
+				break
+			}
+		}
+	}
+
 	frame.merged = nil
 }
 
@@ -59,6 +98,62 @@ func (frame *Frame) SetVars(m map[string]string) {
 	frame.merged = nil
 }
 
+// SetExpandedVars sets variables in a Frame from a map, expanding their
+// references to variables, strictly or not. Variables of the map may
+// reference each other whatever their order, a variable referencing itself
+// getting the value it had before being set.
+func (frame *Frame) SetExpandedVars(m map[string]string, strict bool) error {
+	var (
+		errs    []error
+		resolve func(name string) string
+	)
+
+	expanded := make(map[string]string, len(m))
+	resolving := make(map[string]bool)
+
+	resolve = func(name string) string {
+		if val, ok := expanded[name]; ok {
+			return val
+		}
+
+		resolving[name] = true
+		val, err := varref.ExpandLookup(m[name], func(ref string) (string, bool) {
+			if _, ok := m[ref]; !ok || ref == name {
+				return frame.Lookup(ref)
+			}
+
+			if resolving[ref] {
+				errs = append(errs, fmt.Errorf("%w: `%s` and `%s`", ErrVarCycle, ref, name))
+
+				return frame.Lookup(ref)
+			}
+
+			return resolve(ref), true
+		}, strict)
+		delete(resolving, name)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("variable `%s`: %w", name, err))
+		}
+
+		expanded[name] = val
+
+		return val
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		resolve(name)
+	}
+
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+
+	frame.SetVars(expanded)
+
+	return nil
+}
+
 // Merge computes and returns all frame variables in a single map: its own variables,
 // inherited variables from enclosing frame, and environment variables.
 func (frame *Frame) Merge() map[string]string {
@@ -76,8 +171,11 @@ func (frame *Frame) Merge() map[string]string {
 	}
 
 	if frame.enclosing != nil {
-		parent := frame.enclosing.Merge()
-		maps.Copy(frame.merged, parent)
+		for name, val := range frame.enclosing.Merge() {
+			if frame.inherits(name) {
+				frame.merged[name] = val
+			}
+		}
 	}
 
 	maps.Copy(frame.merged, frame.vars)
@@ -85,6 +183,45 @@ func (frame *Frame) Merge() map[string]string {
 	return frame.merged
 }
 
+// inherits reports whether a variable of the enclosing frame is inherited,
+// which is not the case of environment variables filtered out by the frame.
+// The frame must be locked.
+func (frame *Frame) inherits(name string) bool {
+	if !frame.environFiltered || !frame.enclosing.fromEnviron(name) {
+		return true
+	}
+
+	for _, pattern := range frame.environPatterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fromEnviron reports whether the merged value of a variable comes from the
+// environment variables rather than from variables set in a frame.
+func (frame *Frame) fromEnviron(name string) bool {
+	frame.lock.Lock()
+	_, set := frame.vars[name]
+	_, inEnviron := frame.environ[name]
+	enclosing := frame.enclosing
+	frame.lock.Unlock()
+
+	if set {
+		return false
+	}
+
+	if enclosing != nil {
+		if _, inherited := enclosing.Merge()[name]; inherited {
+			return enclosing.fromEnviron(name)
+		}
+	}
+
+	return inEnviron
+}
+
 // EnvList returns the frame merged variables as list of NAME=VALUE strings.
 func (frame *Frame) EnvList() []string {
 	merged := frame.Merge()
@@ -99,17 +236,54 @@ func (frame *Frame) EnvList() []string {
 
 // ExpandMapping is a helper function for expansion.Expand().
 func (frame *Frame) ExpandMapping() func(string) string {
-	merged := frame.Merge()
-
 	return func(input string) string {
-		if val, ok := merged[input]; ok {
-			return val
+		if ref, ok := varref.ParseReference(input); ok {
+			if val, defined, err := ref.Resolve(frame.Lookup); err == nil && defined {
+				return val
+			}
 		}
 
 		return "$(" + input + ")"
 	}
 }
 
+// Lookup returns the value of a frame variable and whether it is defined.
+func (frame *Frame) Lookup(name string) (string, bool) {
+	val, ok := frame.Merge()[name]
+
+	return val, ok
+}
+
+// Splat returns the words a splat word with the given variable name expands
+// to, and whether the variable is defined. Task arguments are the words of
+// `@` and `TPKL_TASK_ARGS`, other variables words are the lines of their value.
+func (frame *Frame) Splat(name string) ([]string, bool) {
+	if name == varref.SplatArgs || name == prefixedVarName("TASK_ARGS") {
+		argc, _ := strconv.Atoi(frame.Merge()[prefixedVarName("TASK_ARGC")])
+		args := make([]string, 0, argc)
+
+		for i := range argc {
+			args = append(args, frame.Merge()[prefixedVarName("TASK_ARG_"+strconv.Itoa(i))])
+		}
+
+		return args, true
+	}
+
+	val, ok := frame.Lookup(name)
+	if !ok || val == "" {
+		return []string{}, ok
+	}
+
+	return strings.Split(strings.TrimSuffix(val, "\n"), "\n"), true
+}
+
+// Expand replaces variable references in the input string with the values
+// of the frame variables. In strict mode references to undefined variables
+// are errors.
+func (frame *Frame) Expand(input string, strict bool) (string, error) {
+	return varref.ExpandLookup(input, frame.Lookup, strict) //nolint:wrapcheck
+}
+
 var (
 	_environOnce sync.Once
 	_osEnviron   map[string]string
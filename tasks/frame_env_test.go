@@ -1,9 +1,12 @@
 package tasks_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/stoned/tpkl/internal/varref"
 	"github.com/stoned/tpkl/tasks"
 )
 
@@ -123,3 +126,143 @@ func TestExpandMapping(t *testing.T) {
 		}
 	}
 }
+
+func TestFramesWithEnvironMatching(t *testing.T) {
+	t.Parallel()
+
+	frame := tasks.NewFrame()
+	frame.SetEnvironMatching([]string{"P?TH", "TPKL_TEST_*"})
+
+	merged := frame.Merge()
+	for name, val := range tasks.GetEnviron() {
+		got, ok := merged[name]
+		want := name == "PATH" || strings.HasPrefix(name, "TPKL_TEST_")
+
+		if ok != want {
+			t.Errorf("Frame with matching environment: variable %q passed %t, want %t", name, ok, want)
+		}
+
+		if ok && got != val {
+			diff := cmp.Diff(val, got)
+			t.Errorf("Frame with matching environment mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestSetExpandedVars(t *testing.T) {
+	t.Parallel()
+
+	frame := tasks.NewEnclosedFrame(tasks.NewFrame())
+	frame.SetVar("VAR_0", "val0")
+	frame.SetVar("VAR_C", "valC")
+
+	err := frame.SetExpandedVars(map[string]string{
+		"VAR_A": "$(VAR_B)-a",
+		"VAR_B": "$(VAR_0)-b",
+		"VAR_C": "$(VAR_C)-c",
+		"VAR_D": "$(VAR_NOT_THERE)",
+	}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]string{
+		"VAR_0": "val0",
+		"VAR_A": "val0-b-a",
+		"VAR_B": "val0-b",
+		"VAR_C": "valC-c",
+		"VAR_D": "$(VAR_NOT_THERE)",
+	}
+
+	if diff := cmp.Diff(expected, frame.Merge()); diff != "" {
+		t.Errorf("Frame expanded variables mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetExpandedVarsCycle(t *testing.T) {
+	t.Parallel()
+
+	frame := tasks.NewFrame()
+
+	err := frame.SetExpandedVars(map[string]string{
+		"VAR_A": "$(VAR_B)",
+		"VAR_B": "$(VAR_C)",
+		"VAR_C": "$(VAR_A)",
+	}, false)
+	if !errors.Is(err, tasks.ErrVarCycle) {
+		t.Fatalf("expected error %q, got %v", tasks.ErrVarCycle, err)
+	}
+
+	if _, ok := frame.Merge()["VAR_A"]; ok {
+		t.Errorf("expected no variable set on error")
+	}
+}
+
+func TestSetExpandedVarsNested(t *testing.T) {
+	t.Parallel()
+
+	frame := tasks.NewFrame()
+	frame.SetVar("VAR_0", "val0")
+
+	err := frame.SetExpandedVars(map[string]string{
+		"VAR_A": "$(VAR_NOT_THERE:-$(VAR_0))",
+	}, false)
+	if !errors.Is(err, varref.ErrNested) {
+		t.Fatalf("expected error %q, got %v", varref.ErrNested, err)
+	}
+}
+
+func TestSetExpandedVarsStrict(t *testing.T) {
+	t.Parallel()
+
+	frame := tasks.NewFrame()
+
+	err := frame.SetExpandedVars(map[string]string{
+		"VAR_A": "$(VAR_NOT_THERE:-a)",
+		"VAR_B": "$(VRESION)",
+	}, true)
+	if !errors.Is(err, varref.ErrUndefined) {
+		t.Fatalf("expected error %q, got %v", varref.ErrUndefined, err)
+	}
+
+	expected := "variable `VAR_B`: undefined variable: `VRESION`"
+	if err.Error() != expected {
+		t.Errorf("expected error message %q, got %q", expected, err)
+	}
+}
+
+func TestSplat(t *testing.T) {
+	t.Parallel()
+
+	frame := tasks.NewFrame()
+	frame.SetVars(map[string]string{
+		"TPKL_TASK_ARGC":  "2",
+		"TPKL_TASK_ARG_0": "a a",
+		"TPKL_TASK_ARG_1": "",
+		"LIST":            "one\ntwo\n",
+		"EMPTY":           "",
+	})
+
+	cases := []struct {
+		name     string
+		expected []string
+		defined  bool
+	}{
+		{name: "@", expected: []string{"a a", ""}, defined: true},
+		{name: "TPKL_TASK_ARGS", expected: []string{"a a", ""}, defined: true},
+		{name: "LIST", expected: []string{"one", "two"}, defined: true},
+		{name: "EMPTY", expected: []string{}, defined: true},
+		{name: "UNDEFINED", expected: []string{}, defined: false},
+	}
+
+	for _, testCase := range cases {
+		words, defined := frame.Splat(testCase.name)
+		if defined != testCase.defined {
+			t.Errorf("%s: expected defined %t, got %t", testCase.name, testCase.defined, defined)
+		}
+
+		if diff := cmp.Diff(testCase.expected, words); diff != "" {
+			t.Errorf("%s: splat mismatch (-want +got):\n%s", testCase.name, diff)
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"maps"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,20 +25,28 @@ import (
 	"mvdan.cc/sh/v3/interp"
 	"mvdan.cc/sh/v3/syntax"
 
-	"github.com/stoned/tpkl/internal/expansion"
+	"github.com/stoned/tpkl/internal/dotenv"
+	"github.com/stoned/tpkl/internal/secrets"
+	"github.com/stoned/tpkl/internal/varref"
 	"github.com/stoned/tpkl/log"
 	"github.com/stoned/tpkl/modules/tpkl"
 )
 
 // RunOptions are options for Run().
 type runOptions struct {
-	args       []string
-	env        []string
-	module     string
-	properties []string
-	timeout    *time.Duration
-	verbose    int
-	workingDir string
+	args        []string
+	env         []string
+	envReport   bool
+	keepFiles   string
+	maskOutput  bool
+	module      string
+	properties  []string
+	shellStrict bool
+	strictVars  bool
+	timeout     *time.Duration
+	traceShell  bool
+	verbose     int
+	workingDir  string
 }
 
 // RunOption is Run()'s options interface.
@@ -52,6 +64,21 @@ func (e *envOption) setRunOption(o *runOptions) {
 	o.env = e.env
 }
 
+// Set env report Run()'s option.
+func (e *envReportOption) setRunOption(o *runOptions) {
+	o.envReport = e.envReport
+}
+
+// Set keep files Run()'s option.
+func (k *keepFilesOption) setRunOption(o *runOptions) {
+	o.keepFiles = k.keepFiles
+}
+
+// Set mask output Run()'s option.
+func (m *maskOutputOption) setRunOption(o *runOptions) {
+	o.maskOutput = m.maskOutput
+}
+
 // Set module Run()'s option.
 func (m *moduleOption) setRunOption(o *runOptions) {
 	o.module = m.module
@@ -62,11 +89,26 @@ func (p *propertiesOption) setRunOption(o *runOptions) {
 	o.properties = p.properties
 }
 
+// Set shell strict Run()'s option.
+func (s *shellStrictOption) setRunOption(o *runOptions) {
+	o.shellStrict = s.shellStrict
+}
+
+// Set strict variables Run()'s option.
+func (s *strictVarsOption) setRunOption(o *runOptions) {
+	o.strictVars = s.strictVars
+}
+
 // Set timeout Run()'s option.
 func (t *timeoutOption) setRunOption(o *runOptions) {
 	o.timeout = t.timeout
 }
 
+// Set trace shell Run()'s option.
+func (t *traceShellOption) setRunOption(o *runOptions) {
+	o.traceShell = t.traceShell
+}
+
 // Set verbose Run()'s option.
 func (v *verbosityOption) setRunOption(o *runOptions) {
 	o.verbose = v.verbose
@@ -84,9 +126,19 @@ func Run(ctx context.Context, taskName string, options ...RunOption) error {
 		opt.setRunOption(opts)
 	}
 
+	if opts.verbose > 2 { //nolint:mnd
+		opts.traceShell = true
+	}
+
 	logger := log.FromContext(ctx).With().Str("task", taskName).Logger()
 	ctx = logger.WithContext(ctx)
 
+	switch opts.keepFiles {
+	case "", KeepFilesNever, KeepFilesOnFailure, KeepFilesAlways:
+	default:
+		return fmt.Errorf("%w: keep files: %q", ErrInvalidOption, opts.keepFiles)
+	}
+
 	opts.module, err = useModule(ctx, opts.module, opts.workingDir)
 	if err != nil {
 		return fmt.Errorf("run task: %w", err)
@@ -110,9 +162,23 @@ func Run(ctx context.Context, taskName string, options ...RunOption) error {
 		return err
 	}
 
+	err = planVars(taskName, tasks, frame, opts.strictVars)
+	if err != nil {
+		return err
+	}
+
 	termChannel, termWaitGroup := termHandler()
 
-	err = runTask(ctx, taskName, tasks, frame, termChannel, termWaitGroup)
+	run := &taskRun{
+		tasks:         tasks,
+		options:       opts,
+		termChannel:   termChannel,
+		termWaitGroup: termWaitGroup,
+		runFiles:      make(map[string]*taskFiles),
+	}
+
+	err = runTask(ctx, taskName, run, frame)
+	run.releaseRunFiles(ctx, err != nil)
 	if context.Cause(ctx) != nil {
 		err = fmt.Errorf("%w: %w", context.Cause(ctx), err)
 	}
@@ -157,11 +223,7 @@ func newTopFrame(taskName string, module string, env []string, args []string) *F
 		frame.setPrefixedVar("ARG_"+strconv.Itoa(i), a)
 	}
 
-	frame.setPrefixedVar("TASK_ARGC", strconv.Itoa(len(args)))
-
-	for i, a := range args {
-		frame.setPrefixedVar("TASK_ARG_"+strconv.Itoa(i), a)
-	}
+	frame.setTaskArgs(args)
 
 	frame.setPrefixedVar("MODULE", module)
 	frame.setPrefixedVar("MODULEDIR", moduleDir(module))
@@ -170,18 +232,188 @@ func newTopFrame(taskName string, module string, env []string, args []string) *F
 	return frame
 }
 
-func newTaskFrame(taskName string, task tpkl.Task, enclosingFrame *Frame) *Frame {
+// newPlanFiles returns task files whose directory and paths are placeholders.
+func newPlanFiles(files map[string]tpkl.File) *taskFiles {
+	planFiles := &taskFiles{Dir: os.TempDir(), Files: make(map[string]taskFile)}
+	for key, file := range files {
+		planFiles.Files[key] = taskFile{Path: os.TempDir(), Varname: file.Varname}
+	}
+
+	return planFiles
+}
+
+// newTaskFrame creates the frame of a task. Its environment variables are
+// expanded last, so that they can reference variables from environment files
+// and task files paths.
+func newTaskFrame(taskName string, task tpkl.Task, enclosingFrame *Frame, strict bool,
+	tfiles *taskFiles, runFiles *taskFiles,
+) (*Frame, error) {
 	frame := NewEnclosedFrame(enclosingFrame)
 
-	frame.SetVars(task.GetEnv())
+	frame.setPrefixedVar("CURRENT_TASK", taskName)
 
-	if task.GetInheritEnv() {
+	if passthrough := task.GetEnvPassthrough(); len(passthrough) != 0 {
+		for _, pattern := range passthrough {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%w: `%s`: %w", ErrEnvPattern, pattern, err)
+			}
+		}
+
+		frame.SetEnvironMatching(passthrough)
+	} else if task.GetInheritEnv() {
 		frame.SetEnviron()
+	} else {
+		frame.SetEnvironMatching(nil)
 	}
 
-	frame.setPrefixedVar("CURRENT_TASK", taskName)
+	envFilesVars, err := loadEnvFiles(task.GetEnvFiles(), frame.moduleDir())
+	if err != nil {
+		return nil, err
+	}
 
-	return frame
+	frame.SetVars(envFilesVars)
+
+	err = frame.setTaskFilesVars(tfiles, runFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	err = frame.SetExpandedVars(task.GetEnv(), strict)
+	if err != nil {
+		return nil, fmt.Errorf("task `%s`: %w", taskName, err)
+	}
+
+	frame.prependPath(task.GetPath())
+
+	return frame, nil
+}
+
+// writeEnvReport writes which process environment variables were passed to
+// or dropped from a task's frame, which variables were inherited from the
+// enclosing frame and which ones were set for the task.
+func writeEnvReport(writer io.Writer, taskName string, frame *Frame) error {
+	var parent map[string]string
+
+	if frame.enclosing != nil {
+		parent = frame.enclosing.Merge()
+	}
+
+	frame.lock.Lock()
+	inherited := slices.Sorted(maps.Keys(parent))
+	inherited = slices.DeleteFunc(inherited, func(name string) bool { return !frame.inherits(name) })
+	passed := slices.Sorted(maps.Keys(frame.environ))
+	set := slices.Sorted(maps.Keys(frame.vars))
+	frame.lock.Unlock()
+
+	dropped := slices.Sorted(maps.Keys(GetEnviron()))
+	dropped = slices.DeleteFunc(dropped, func(name string) bool {
+		_, found := slices.BinarySearch(passed, name)
+
+		return found
+	})
+
+	_, err := fmt.Fprintf(writer, "environment of task `%s`:\n", taskName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrIO, err)
+	}
+
+	for _, entry := range []struct {
+		status string
+		names  []string
+	}{
+		{"passed", passed},
+		{"inherited", inherited},
+		{"set", set},
+		{"dropped", dropped},
+	} {
+		for _, name := range entry.names {
+			_, err = fmt.Fprintf(writer, "  %-9s %s\n", entry.status, name)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrIO, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadEnvFiles returns the variables read from environment files, later
+// files overriding earlier ones. Relative paths are resolved against dir and
+// files whose path is prefixed with `-` are optional.
+func loadEnvFiles(envFiles []string, dir string) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	for _, envFile := range envFiles {
+		path, optional := strings.CutPrefix(envFile, "-")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		file, err := os.Open(path) // #nosec G304
+		if err != nil {
+			if optional && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("%w: %w", ErrEnvFile, err)
+		}
+
+		fileVars, err := dotenv.Parse(file)
+		_ = file.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrEnvFile, path, err)
+		}
+
+		maps.Copy(vars, fileVars)
+	}
+
+	return vars, nil
+}
+
+type contextKey byte
+
+const (
+	outputsContextKey contextKey = iota
+)
+
+// taskRun holds the state shared by the tasks executed by Run().
+type taskRun struct {
+	tasks         Tasks
+	options       *runOptions
+	termChannel   chan any
+	termWaitGroup *sync.WaitGroup
+	runFiles      map[string]*taskFiles
+	runFilesLock  sync.Mutex
+}
+
+// taskRunFiles returns the run scoped files of a task, created on its first call.
+func (run *taskRun) taskRunFiles(ctx context.Context, taskName string, files map[string]tpkl.File,
+	keep string,
+) (*taskFiles, error) {
+	run.runFilesLock.Lock()
+	defer run.runFilesLock.Unlock()
+
+	if tfiles, ok := run.runFiles[taskName]; ok {
+		return tfiles, nil
+	}
+
+	tfiles, err := newTaskFiles(ctx, files, keep, run.termChannel, run.termWaitGroup)
+	if tfiles != nil {
+		run.runFiles[taskName] = tfiles
+	}
+
+	return tfiles, err
+}
+
+// releaseRunFiles releases the run scoped files of all tasks.
+func (run *taskRun) releaseRunFiles(ctx context.Context, failed bool) {
+	run.runFilesLock.Lock()
+	defer run.runFilesLock.Unlock()
+
+	for _, tfiles := range run.runFiles {
+		tfiles.release(ctx, failed)
+	}
 }
 
 type planNode struct {
@@ -210,13 +442,20 @@ func planTask(_ context.Context, start string, tasks Tasks) error {
 		task := tasks[name]
 		node := &planNode{task: task}
 
-		for _, cmd := range task.GetCmds() {
-			if cmd.Task == nil {
-				continue
+		for cmdIdx, cmd := range allCommands(task.GetCmds()) {
+			_, err := commandWords(cmd)
+			if err == nil {
+				_, err = pipeWords(cmd)
 			}
 
-			if !taskExists(*cmd.Task) {
-				return nil, fmt.Errorf("plan for task `%s`: %w: `%s`", start, ErrUnknownTask, *cmd.Task)
+			if err != nil {
+				return nil, fmt.Errorf("plan for task `%s`: task `%s`: command %s: %w", start, name, cmdIdx, err)
+			}
+		}
+
+		for _, call := range taskCalls(task) {
+			if !taskExists(call) {
+				return nil, fmt.Errorf("plan for task `%s`: %w: `%s`", start, ErrUnknownTask, call)
 			}
 
 			if parent != "" {
@@ -232,7 +471,7 @@ func planTask(_ context.Context, start string, tasks Tasks) error {
 				}
 			}
 
-			child, err := plan(name, *cmd.Task)
+			child, err := plan(name, call)
 			if err != nil {
 				return node, err
 			}
@@ -252,26 +491,282 @@ func planTask(_ context.Context, start string, tasks Tasks) error {
 	return err
 }
 
-func runTask(ctx context.Context, taskName string,
-	tasks Tasks, enclosingFrame *Frame,
-	termChannel chan any, termWaitGroup *sync.WaitGroup,
-) error {
-	var cmdErr error
+// taskCalls returns the names of the tasks called by the commands of a
+// task, including the statically visible calls of embedded shell scripts.
+func taskCalls(task tpkl.Task) []string {
+	var calls []string
+
+	for _, cmd := range allCommands(task.GetCmds()) {
+		switch {
+		case cmd.Task != nil:
+			calls = append(calls, *cmd.Task)
+		case cmd.EmbeddedShell && len(cmd.Cmd) > 0:
+			calls = append(calls, shellTaskCalls(cmd.Cmd[0])...)
+		}
+	}
+
+	return calls
+}
+
+// allCommands returns the commands, including the ones of parallel groups,
+// with their indexes, e.g. `2.0` for the first command of the third one.
+func allCommands(cmds []tpkl.Command) iter.Seq2[string, tpkl.Command] {
+	return func(yield func(string, tpkl.Command) bool) {
+		for cmdIdx, cmd := range cmds {
+			if !yield(strconv.Itoa(cmdIdx), cmd) {
+				return
+			}
+
+			for childIdx, child := range allCommands(cmd.Parallel) {
+				if !yield(strconv.Itoa(cmdIdx)+"."+childIdx, child) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// planVars returns an error listing the references to undefined variables of
+// tasks to be run in strict variables mode, simulating their frames.
+func planVars(start string, tasks Tasks, topFrame *Frame, strict bool) error {
+	var (
+		undefined []string
+		plan      func(string, *Frame) error
+	)
+
+	if !strict && !slices.ContainsFunc(slices.Collect(maps.Values(tasks)), tpkl.Task.GetStrictVars) {
+		return nil
+	}
+
+	plan = func(name string, enclosingFrame *Frame) error {
+		task := tasks[name]
 
+		frame, err := newPlanFrame(name, task, enclosingFrame)
+		if err != nil {
+			return fmt.Errorf("plan for task `%s`: %w", start, err)
+		}
+
+		if strict || task.GetStrictVars() {
+			vars := &varsCheck{taskName: name, frame: frame}
+			vars.checkTask(task)
+			undefined = append(undefined, vars.undefined...)
+		}
+
+		for _, call := range taskCalls(task) {
+			err = plan(call, frame)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err := plan(start, topFrame)
+	if err != nil {
+		return err
+	}
+
+	if len(undefined) != 0 {
+		return fmt.Errorf("plan for task `%s`: %w: %s", start, varref.ErrUndefined, strings.Join(undefined, ", "))
+	}
+
+	return nil
+}
+
+// varsCheck collects the references to undefined variables of a task, frame
+// simulating the one it has when run.
+type varsCheck struct {
+	taskName  string
+	frame     *Frame
+	undefined []string
+}
+
+// check records the references to undefined variables of input, where
+// telling where it comes from in the task.
+func (c *varsCheck) check(where string, input string) {
+	for _, ref := range varref.UndefinedReferences(input, c.frame.Lookup) {
+		c.addUndefined(where, ref)
+	}
+}
+
+// checkWord records the references to undefined variables of a command
+// word, or its variable if it is a splat word.
+func (c *varsCheck) checkWord(where string, word string) {
+	if splatName, ok := varref.ParseSplat(word); ok {
+		if _, defined := c.frame.Splat(splatName); !defined {
+			c.addUndefined(where, splatName)
+		}
+
+		return
+	}
+
+	c.check(where, word)
+}
+
+func (c *varsCheck) addUndefined(where string, name string) {
+	c.undefined = append(c.undefined, fmt.Sprintf("`%s` in task `%s` %s", name, c.taskName, where))
+}
+
+// checkTask checks the environment variables, working directory, files,
+// commands and services of a task.
+func (c *varsCheck) checkTask(task tpkl.Task) {
+	env := task.GetEnv()
+	for _, varName := range slices.Sorted(maps.Keys(env)) {
+		c.check(fmt.Sprintf("env `%s`", varName), env[varName])
+	}
+
+	c.check("working directory", task.GetWorkingDir())
+
+	files := task.GetFiles()
+	for _, key := range slices.Sorted(maps.Keys(files)) {
+		if files[key].Expand && files[key].Content != nil {
+			c.check(fmt.Sprintf("file `%s`", key), *files[key].Content)
+		}
+	}
+
+	for cmdIdx, cmd := range allCommands(task.GetCmds()) {
+		c.checkCommand("command "+cmdIdx, cmd)
+	}
+
+	for _, svc := range task.GetServices() {
+		c.checkService(svc)
+	}
+}
+
+// checkCommand checks the words, pipe stages, working directory, file
+// operation and download of a command.
+func (c *varsCheck) checkCommand(where string, cmd tpkl.Command) {
+	cmdWords, _ := commandWords(cmd)
+	stages, _ := pipeWords(cmd)
+
+	for _, word := range slices.Concat(append([][]string{cmdWords}, stages...)...) {
+		c.checkWord(where, word)
+	}
+
+	if cmd.WorkingDir != nil {
+		c.check(where+" working directory", *cmd.WorkingDir)
+	}
+
+	if cmd.File != nil {
+		c.checkFileOperation(where, cmd.File)
+	}
+
+	if cmd.Download != nil {
+		c.checkDownload(where, cmd.Download)
+	}
+}
+
+func (c *varsCheck) checkFileOperation(where string, file *tpkl.FileOperation) {
+	for _, path := range file.Paths {
+		c.check(where, path)
+	}
+
+	if file.Destination != nil {
+		c.check(where, *file.Destination)
+	}
+
+	if file.Content != nil && file.Expand {
+		c.check(where+" content", *file.Content)
+	}
+}
+
+func (c *varsCheck) checkDownload(where string, download *tpkl.Download) {
+	c.check(where+" url", download.Url)
+	c.check(where+" destination", download.Destination)
+	c.check(where+" sha256", download.Sha256)
+
+	for _, header := range slices.Sorted(maps.Keys(download.Headers)) {
+		c.check(fmt.Sprintf("%s header `%s`", where, header), download.Headers[header])
+	}
+}
+
+// checkService checks the words, but splat ones, and working directory of a
+// service.
+func (c *varsCheck) checkService(svc tpkl.Service) {
+	where := fmt.Sprintf("service `%s`", svc.Name)
+
+	for _, word := range svc.Cmd {
+		if _, ok := varref.ParseSplat(word); !ok {
+			c.check(where, word)
+		}
+	}
+
+	if svc.WorkingDir != nil {
+		c.check(where+" working directory", *svc.WorkingDir)
+	}
+}
+
+// newPlanFrame returns a frame with the variables a task has when run, task
+// files paths and variables values being placeholders. Missing environment
+// files are ignored, as they may be created by commands run before.
+func newPlanFrame(taskName string, task tpkl.Task, enclosingFrame *Frame) (*Frame, error) {
+	files, err := taskFilesDefinitions(task, enclosingFrame.moduleDir())
+	if err != nil {
+		return nil, err
+	}
+
+	taskScoped, runScoped := filesByScope(files)
+	planFiles, runPlanFiles := newPlanFiles(taskScoped), newPlanFiles(runScoped)
+
+	frame := NewEnclosedFrame(enclosingFrame)
+
+	frame.setPrefixedVar("CURRENT_TASK", taskName)
+
+	if passthrough := task.GetEnvPassthrough(); len(passthrough) != 0 {
+		frame.SetEnvironMatching(passthrough)
+	} else if task.GetInheritEnv() {
+		frame.SetEnviron()
+	} else {
+		frame.SetEnvironMatching(nil)
+	}
+
+	envFiles := make([]string, 0, len(task.GetEnvFiles()))
+	for _, envFile := range task.GetEnvFiles() {
+		envFiles = append(envFiles, "-"+strings.TrimPrefix(envFile, "-"))
+	}
+
+	envFilesVars, err := loadEnvFiles(envFiles, frame.moduleDir())
+	if err != nil {
+		return nil, err
+	}
+
+	frame.SetVars(envFilesVars)
+
+	err = frame.setTaskFilesVars(planFiles, runPlanFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	frame.SetVars(task.GetEnv())
+
+	return frame, nil
+}
+
+// runTask runs a task, called from the task of enclosingFrame, if any.
+func runTask(ctx context.Context, taskName string, run *taskRun, enclosingFrame *Frame) (err error) {
 	logger := log.FromContext(ctx).With().Str("cur", taskName).Logger()
 	ctx = logger.WithContext(ctx)
 
-	if _, ok := tasks[taskName]; !ok {
+	if _, ok := run.tasks[taskName]; !ok {
 		return fmt.Errorf("%w: `%s`", ErrUnknownTask, taskName)
 	}
 
-	task := tasks[taskName]
-	frame := newTaskFrame(taskName, task, enclosingFrame)
+	task := run.tasks[taskName]
+
+	keep := keepFilesPolicy(run.options.keepFiles, task.GetKeepFiles())
+
+	files, err := taskFilesDefinitions(task, enclosingFrame.moduleDir())
+	if err != nil {
+		return err
+	}
+
+	taskScopedFiles, runScopedFiles := filesByScope(files)
 
-	taskFiles, err := newTaskFiles(task, frame, termChannel, termWaitGroup)
+	taskFiles, err := newTaskFiles(ctx, taskScopedFiles, keep, run.termChannel, run.termWaitGroup)
 	if taskFiles != nil {
 		defer func() {
-			_ = taskFiles.cleanup()
+			taskFiles.release(ctx, err != nil)
 		}()
 	}
 
@@ -279,55 +774,378 @@ func runTask(ctx context.Context, taskName string,
 		return err
 	}
 
-	expandTaskProperties(task, frame.ExpandMapping())
+	runFiles, err := run.taskRunFiles(ctx, taskName, runScopedFiles, keep)
+	if err != nil {
+		return err
+	}
 
-	for cmdIdx, cmd := range task.GetCmds() {
-		switch {
-		case cmd.Task != nil:
-			logger.Info().Str("call", *cmd.Task).Send()
-			cmdErr = runTask(ctx, *cmd.Task, tasks, frame, termChannel, termWaitGroup)
+	strict := run.options.strictVars || task.GetStrictVars()
+
+	frame, err := run.newTaskRunFrame(taskName, task, enclosingFrame, strict, taskFiles, runFiles)
+	if err != nil {
+		return err
+	}
+
+	cmds, err := expandCommands(ctx, taskName, task.GetCmds(), frame, strict)
+	if err != nil {
+		return fmt.Errorf("task `%s`: %w", taskName, err)
+	}
+
+	runner := &commandRunner{
+		run:       run,
+		task:      task,
+		frame:     frame,
+		filesDirs: filesDirs(taskFiles, runFiles),
+		expand: func(input string) (string, error) {
+			return frame.Expand(input, strict)
+		},
+	}
+
+	taskDir, err := taskWorkingDir(task, frame, runner.expand)
+	if err != nil {
+		return fmt.Errorf("task `%s`: %w", taskName, err)
+	}
+
+	runner.stdout, runner.stderr = run.outputs(ctx)
+
+	services, err := startServices(ctx, task.GetServices(), frame, taskDir, strict, runner.stdout, runner.stderr,
+		run.termChannel, run.termWaitGroup)
+	defer stopServices(ctx, services)
+
+	if err != nil {
+		return fmt.Errorf("task `%s`: %w", taskName, err)
+	}
+
+	return runner.runCommands(ctx, taskName, cmds, taskDir)
+}
+
+// newTaskRunFrame creates the frame of a task to be run, writes its files and
+// records its secret variables.
+func (run *taskRun) newTaskRunFrame(taskName string, task tpkl.Task, enclosingFrame *Frame, strict bool,
+	taskFiles *taskFiles, runFiles *taskFiles,
+) (*Frame, error) {
+	frame, err := newTaskFrame(taskName, task, enclosingFrame, strict, taskFiles, runFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	expand := func(input string) (string, error) {
+		return frame.Expand(input, strict)
+	}
+
+	err = taskFiles.write(frame.moduleDir(), expand)
+	if err != nil {
+		return nil, fmt.Errorf("task `%s`: %w", taskName, err)
+	}
+
+	err = runFiles.write(frame.moduleDir(), expand)
+	if err != nil {
+		return nil, fmt.Errorf("task `%s`: %w", taskName, err)
+	}
+
+	for _, name := range task.GetSecretEnv() {
+		if value, ok := frame.Merge()[name]; ok {
+			secrets.Add(value)
+		}
+	}
+
+	if run.options.envReport {
+		err = writeEnvReport(os.Stderr, taskName, frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return frame, nil
+}
 
-		case cmd.EmbeddedShell:
-			logger.Info().Str("shell", displayCommand(cmd.Cmd)).Send()
-			log.DebugShell(ctx, cmd.Cmd)
+// commandRunner runs the expanded commands of a task.
+type commandRunner struct {
+	run       *taskRun
+	task      tpkl.Task
+	frame     *Frame
+	filesDirs []string
+	expand    func(string) (string, error)
+	stdout    io.Writer
+	stderr    io.Writer
+}
 
-			scriptName := fmt.Sprintf("%s[%d]", taskName, cmdIdx)
-			cmdErr = runShell(ctx, scriptName, cmd.Cmd, task.GetWorkingDir(), frame.EnvList())
+// runCommands runs the commands of a task, in their working directories
+// relative to taskDir, stopping at the first failing one which must succeed.
+func (r *commandRunner) runCommands(ctx context.Context, taskName string, cmds []expandedCommand,
+	taskDir string,
+) error {
+	logger := log.FromContext(ctx)
 
-		default:
-			logger.Info().Str("cmd", displayCommand(cmd.Cmd)).Send()
-			log.DebugCmd(ctx, cmd.Cmd)
+	var session *shellSession
+	if r.task.GetShellSession() {
+		session = &shellSession{}
+	}
 
-			cmdErr = runCmd(ctx, cmd.Cmd, task.GetWorkingDir(), frame.EnvList())
+	for cmdIdx, cmd := range cmds {
+		dir, err := commandWorkingDir(cmd.Command, taskDir, r.expand)
+		if err != nil {
+			return fmt.Errorf("task `%s`: command %d: %w", taskName, cmdIdx, err)
 		}
 
-		if cmdErr != nil {
+		err = r.runCommand(ctx, fmt.Sprintf("%s[%d]", taskName, cmdIdx), cmd, dir, session)
+		if err != nil {
 			if cmd.MustSucceed {
-				logger.Err(cmdErr).Msg("command failed")
+				logger.Err(err).Msg("command failed")
 
-				return cmdErr
+				return err
 			}
 
-			logger.Info().Err(cmdErr).Msg("ignoring failed command")
+			logger.Info().Err(err).Msg("ignoring failed command")
 		}
 	}
 
 	return nil
 }
 
+// runCommand runs a command in dir, according to its kind. Embedded shell
+// commands run in session, unless it is nil.
+func (r *commandRunner) runCommand(ctx context.Context, scriptName string, cmd expandedCommand, dir string,
+	session *shellSession,
+) error {
+	defer flushOutputs(r.stdout, r.stderr)
+
+	logger := log.FromContext(ctx)
+
+	switch {
+	case cmd.Task != nil:
+		logger.Info().Str("call", *cmd.Task).Send()
+
+		return runTask(ctx, *cmd.Task, r.run, r.frame)
+
+	case cmd.File != nil:
+		logger.Info().Str("file", displayFileOperation(cmd.File)).Send()
+
+		return runFileOperation(cmd.File, dir)
+
+	case cmd.Download != nil:
+		// Headers are not logged, as they may hold credentials.
+		logger.Info().Str("download", cmd.Download.Url).Str("destination", cmd.Download.Destination).Send()
+
+		return runDownload(ctx, cmd.Download, dir)
+
+	case len(cmd.Pipe) > 0:
+		logger.Info().Str("pipe", displayPipe(cmd.Pipe)).Send()
+
+		for _, stage := range cmd.Pipe {
+			log.DebugCmd(ctx, stage)
+		}
+
+		return runPipe(ctx, cmd.Pipe, dir, append(r.frame.EnvList(), cmd.environ...), r.stdout, r.stderr)
+
+	case len(cmd.parallel) > 0:
+		return r.runParallelCommand(ctx, scriptName, cmd, dir)
+
+	case cmd.EmbeddedShell:
+		return r.runShellCommand(ctx, scriptName, cmd, dir, session)
+
+	default:
+		logger.Info().Str("cmd", displayCommand(cmd.Cmd)).Send()
+		log.DebugCmd(ctx, cmd.Cmd)
+
+		return runCmd(ctx, cmd.Cmd, dir, append(r.frame.EnvList(), cmd.environ...), r.stdout, r.stderr)
+	}
+}
+
+// runParallelCommand runs the commands of a parallel group concurrently.
+// They do not share the shell session of the task, which runs one command
+// at a time.
+func (r *commandRunner) runParallelCommand(ctx context.Context, scriptName string, cmd expandedCommand,
+	dir string,
+) error {
+	log.FromContext(ctx).Info().Int("parallel", len(cmd.parallel)).Send()
+
+	return runParallel(ctx, cmd.parallel, func(ctx context.Context, childIdx int, child expandedCommand) error {
+		childDir, err := commandWorkingDir(child.Command, dir, r.expand)
+		if err != nil {
+			return fmt.Errorf("command %d: %w", childIdx, err)
+		}
+
+		return r.runCommand(ctx, fmt.Sprintf("%s[%d]", scriptName, childIdx), child, childDir, nil)
+	})
+}
+
+// runShellCommand runs an embedded shell command, in session unless it is
+// nil.
+func (r *commandRunner) runShellCommand(ctx context.Context, scriptName string, cmd expandedCommand, dir string,
+	session *shellSession,
+) error {
+	logger := log.FromContext(ctx)
+	logger.Info().Str("shell", displayCommand(cmd.Cmd)).Send()
+	log.DebugShell(ctx, cmd.Cmd)
+
+	options := shellOptions(r.task.GetShellOptions(), cmd.ShellOptions, r.run.options.shellStrict)
+	shellCtx := logger.With().Str("script", scriptName).Logger().WithContext(ctx)
+	runnerOptions := r.run.shellRunnerOptions(r.task, r.frame, r.filesDirs)
+
+	if session != nil {
+		err := session.run(shellCtx, scriptName, cmd.Cmd, options, dir, cmd.WorkingDir != nil,
+			r.frame.EnvList(), cmd.environ, r.stdout, r.stderr, runnerOptions...)
+		session.export(r.frame)
+
+		return err
+	}
+
+	return runShell(shellCtx, scriptName, cmd.Cmd, options, dir,
+		append(r.frame.EnvList(), cmd.environ...), r.stdout, r.stderr, runnerOptions...)
+}
+
+// runParallel runs commands concurrently with runCommand, sharing a context
+// cancelled as soon as one of them which must succeed fails. It returns the
+// errors of the failed commands which must succeed, but the ones cancelled,
+// joined, with the exit code of the first one failing.
+func runParallel(ctx context.Context, cmds []expandedCommand,
+	runCommand func(context.Context, int, expandedCommand) error,
+) error {
+	var (
+		waitGroup sync.WaitGroup
+		failure   sync.Once
+		failed    bool
+		exitCode  int
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger := log.FromContext(ctx)
+	errs := make([]error, len(cmds))
+
+	for cmdIdx, cmd := range cmds {
+		waitGroup.Go(func() {
+			err := runCommand(ctx, cmdIdx, cmd)
+			if err == nil {
+				return
+			}
+
+			if !cmd.MustSucceed {
+				logger.Info().Err(err).Int("parallel", cmdIdx).Msg("ignoring failed command")
+
+				return
+			}
+
+			cancelled := ctx.Err() != nil
+			first := false
+
+			failure.Do(func() {
+				first = true
+				failed = true
+				exitCode = 1
+
+				var cmdErr *CmdError
+				if errors.As(err, &cmdErr) {
+					exitCode = cmdErr.ExitCode
+				}
+
+				cancel()
+			})
+
+			// Commands failing because of the cancellation are not reported.
+			if cancelled && !first {
+				logger.Debug().Err(err).Int("parallel", cmdIdx).Msg("cancelled command")
+
+				return
+			}
+
+			errs[cmdIdx] = fmt.Errorf("parallel command %d: %w", cmdIdx, err)
+		})
+	}
+
+	waitGroup.Wait()
+
+	if !failed {
+		return nil
+	}
+
+	return NewCmdError(exitCode, errors.Join(errs...))
+}
+
+// taskWorkingDir returns the working directory of a task's commands.
+func taskWorkingDir(task tpkl.Task, frame *Frame, expand func(string) (string, error)) (string, error) {
+	dir, err := expand(task.GetWorkingDir())
+	if err != nil {
+		return "", fmt.Errorf("working directory: %w", err)
+	}
+
+	if filepath.IsAbs(dir) || !task.GetWorkingDirRelativeToModule() {
+		return dir, nil
+	}
+
+	return filepath.Join(frame.moduleDir(), dir), nil
+}
+
+// commandWorkingDir returns the working directory of a command.
+func commandWorkingDir(cmd tpkl.Command, taskDir string, expand func(string) (string, error)) (string, error) {
+	if cmd.WorkingDir == nil {
+		return taskDir, nil
+	}
+
+	dir, err := expand(*cmd.WorkingDir)
+	if err != nil {
+		return "", fmt.Errorf("working directory: %w", err)
+	}
+
+	if filepath.IsAbs(dir) {
+		return dir, nil
+	}
+
+	return filepath.Join(taskDir, dir), nil
+}
+
+// outputs returns the writers for commands standard output and error, the
+// ones of the context if any.
+func (run *taskRun) outputs(ctx context.Context) (io.Writer, io.Writer) {
+	if outputs, ok := ctx.Value(outputsContextKey).([2]io.Writer); ok {
+		return outputs[0], outputs[1]
+	}
+
+	if !run.options.maskOutput {
+		return os.Stdout, os.Stderr
+	}
+
+	return secrets.Default().NewWriter(os.Stdout), secrets.Default().NewWriter(os.Stderr)
+}
+
+// contextWithOutputs returns a context whose writers for commands standard
+// output and error are stdout and stderr.
+func contextWithOutputs(ctx context.Context, stdout, stderr io.Writer) context.Context {
+	return context.WithValue(ctx, outputsContextKey, [2]io.Writer{stdout, stderr})
+}
+
+// flushOutputs flushes writers returned by taskRun.outputs() if needed.
+func flushOutputs(writers ...io.Writer) {
+	for _, writer := range writers {
+		if secretsWriter, ok := writer.(*secrets.Writer); ok {
+			_ = secretsWriter.Flush()
+		}
+	}
+}
+
 // runCmd runs an arbitrary command.
-func runCmd(ctx context.Context, command []string, dir string, environ []string) error {
-	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+func runCmd(ctx context.Context, command []string, dir string, environ []string,
+	stdout, stderr io.Writer,
+) error {
+	path, err := lookPath(command[0], environ)
+	if err != nil {
+		return NewCmdError(1, err)
+	}
+
+	cmd := exec.CommandContext(ctx, path, command[1:]...)
+	cmd.Args[0] = command[0]
 	cmd.Dir = dir
 	cmd.Env = environ
 
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	ee := (&exec.ExitError{})
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if errors.As(err, &ee) {
 		ec := ee.ExitCode()
 
@@ -341,20 +1159,117 @@ func runCmd(ctx context.Context, command []string, dir string, environ []string)
 	return nil
 }
 
+// runPipe runs commands concurrently, the standard output of each one being
+// connected to the standard input of the next one. Like a shell pipeline with
+// the pipefail option, it fails with the status of the last failing command.
+func runPipe(ctx context.Context, stages [][]string, dir string, environ []string,
+	stdout, stderr io.Writer,
+) error {
+	cmds := make([]*exec.Cmd, len(stages))
+
+	for stageIdx, command := range stages {
+		path, err := lookPath(command[0], environ)
+		if err != nil {
+			return NewCmdError(1, fmt.Errorf("pipe stage %d: %w", stageIdx, err))
+		}
+
+		cmds[stageIdx] = exec.CommandContext(ctx, path, command[1:]...)
+		cmds[stageIdx].Args[0] = command[0]
+		cmds[stageIdx].Dir = dir
+		cmds[stageIdx].Env = environ
+		cmds[stageIdx].Stderr = stderr
+	}
+
+	cmds[0].Stdin = os.Stdin
+	cmds[len(cmds)-1].Stdout = stdout
+
+	// Pipes ends of started commands are closed in the tpkl process, so that
+	// readers get EOF once writers exit and writers get EPIPE once readers exit.
+	var pipeEnds []*os.File
+
+	defer func() {
+		for _, pipeEnd := range pipeEnds {
+			_ = pipeEnd.Close()
+		}
+	}()
+
+	for stageIdx := range len(cmds) - 1 {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return NewCmdError(1, err)
+		}
+
+		pipeEnds = append(pipeEnds, reader, writer)
+		cmds[stageIdx].Stdout = writer
+		cmds[stageIdx+1].Stdin = reader
+	}
+
+	errs := make([]error, len(cmds))
+
+	for stageIdx, cmd := range cmds {
+		errs[stageIdx] = cmd.Start()
+	}
+
+	for _, pipeEnd := range pipeEnds {
+		_ = pipeEnd.Close()
+	}
+
+	pipeEnds = nil
+
+	for stageIdx, cmd := range cmds {
+		if errs[stageIdx] == nil {
+			errs[stageIdx] = cmd.Wait()
+		}
+	}
+
+	for stageIdx := len(cmds) - 1; stageIdx >= 0; stageIdx-- {
+		err := errs[stageIdx]
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("pipe stage %d `%s`: %w", stageIdx, stages[stageIdx][0], err)
+
+		ee := (&exec.ExitError{})
+		if errors.As(err, &ee) {
+			return NewCmdError(ee.ExitCode(), err)
+		}
+
+		return NewCmdError(1, err)
+	}
+
+	return nil
+}
+
 // runShell runs an arbitrary shell command or script with an mvdan.cc shell interpreter, so called
 // "embedded shell" in tpkl. cf. https://github.com/mvdan/sh
-func runShell(ctx context.Context, taskName string, command []string, dir string, environ []string) error {
-	parser, err := syntax.NewParser().Parse(strings.NewReader(command[0]), taskName)
+func runShell(ctx context.Context, taskName string, command []string, options map[string]bool, dir string,
+	environ []string, stdout, stderr io.Writer, runnerOptions ...interp.RunnerOption,
+) error {
+	runner, err := newShellRunner(shellParams(options, command[1:]), dir, environ, stdout, stderr, runnerOptions...)
 	if err != nil {
 		return NewCmdError(1, err)
 	}
 
-	runner, err := interp.New(
-		interp.Params(command[1:]...),
+	return runShellScript(ctx, runner, taskName, command[0])
+}
+
+// newShellRunner returns an mvdan.cc shell interpreter for an embedded shell
+// command, params setting its options and positional parameters.
+func newShellRunner(params []string, dir string, environ []string, stdout, stderr io.Writer,
+	runnerOptions ...interp.RunnerOption,
+) (*interp.Runner, error) {
+	return interp.New(append([]interp.RunnerOption{
+		interp.Params(params...),
 		interp.Dir(dir),
 		interp.Env(expand.ListEnviron(environ...)),
-		interp.StdIO(os.Stdin, os.Stdout, os.Stderr),
-	)
+		interp.StdIO(os.Stdin, stdout, stderr),
+	}, runnerOptions...)...)
+}
+
+// runShellScript parses and runs a shell script with an mvdan.cc shell interpreter.
+func runShellScript(ctx context.Context, runner *interp.Runner, name string, script string) error {
+	parser, err := syntax.NewParser().Parse(strings.NewReader(script), name)
 	if err != nil {
 		return NewCmdError(1, err)
 	}
@@ -372,6 +1287,42 @@ func runShell(ctx context.Context, taskName string, command []string, dir string
 	return nil
 }
 
+// lookPath searches for an executable named file in the directories named
+// by the PATH variable of environ, instead of the PATH of the tpkl process
+// as exec.LookPath does. Like exec.LookPath, it ignores empty and relative
+// directories, which would be relative to the working directory of tpkl
+// rather than the one of the command. It returns file unchanged if it
+// contains a path separator, and an exec.ErrNotFound error if no executable
+// is found.
+func lookPath(file string, environ []string) (string, error) {
+	if strings.ContainsRune(file, filepath.Separator) {
+		return file, nil
+	}
+
+	var pathEnv string
+
+	for _, variable := range environ {
+		if value, ok := strings.CutPrefix(variable, "PATH="); ok {
+			pathEnv = value
+		}
+	}
+
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+
+		path := filepath.Join(dir, file)
+
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() && info.Mode()&0o111 != 0 {
+			return path, nil
+		}
+	}
+
+	return "", &exec.Error{Name: file, Err: fmt.Errorf("%w (task PATH %q)", exec.ErrNotFound, pathEnv)}
+}
+
 func displayCommand(command []string) string {
 	var displayCommand strings.Builder
 
@@ -391,6 +1342,21 @@ func displayCommand(command []string) string {
 	return truncate(strings.TrimSpace(displayCommand.String()), displayLen)
 }
 
+// displayPipe returns a short representation of the commands of a pipe.
+func displayPipe(stages [][]string) string {
+	command := make([]string, 0, 2*len(stages))
+
+	for _, stage := range stages {
+		if len(command) > 0 {
+			command = append(command, "|")
+		}
+
+		command = append(command, stage...)
+	}
+
+	return displayCommand(command)
+}
+
 func truncate(text string, maxLen int) string {
 	lastSpace := maxLen
 	length := 0
@@ -410,143 +1376,240 @@ func truncate(text string, maxLen int) string {
 	return text
 }
 
-type taskFile struct {
-	Path    string
-	Varname *string
-}
-type taskFiles struct {
-	Dir   string
-	Files map[string]taskFile
+// expandedCommand is a command whose words were expanded, with the variables
+// referenced by its shell script, if any, and its expanded parallel commands.
+type expandedCommand struct {
+	tpkl.Command
+	environ  []string
+	parallel []expandedCommand
 }
 
-func newTaskFiles(task tpkl.Task, frame *Frame,
-	termChannel chan any, termWaitGroup *sync.WaitGroup,
-) (*taskFiles, error) {
-	tfiles := taskFiles{Files: make(map[string]taskFile)}
-	files := task.GetFiles()
+// expandCommands returns a copy of commands with their words expanded, splat
+// words expanding into zero or more words. Variable references of shell
+// scripts, of embedded shell commands or at the script index of commands,
+// are replaced by references to shell variables.
+func expandCommands(ctx context.Context, taskName string, cmds []tpkl.Command, frame *Frame, strict bool,
+) ([]expandedCommand, error) {
+	var errs []error
 
-	if len(files) == 0 {
-		return &tfiles, nil
-	}
+	expanded := make([]expandedCommand, len(cmds))
 
-	dir, err := os.MkdirTemp(os.TempDir(), "tpkl_taskfiles_*")
-	if err != nil {
-		return nil, fmt.Errorf("%w: error creating temporary directory: %w", ErrTaskFile, err)
-	}
+	for cmdIdx, cmd := range cmds {
+		var cmdErrs []error
 
-	termWaitGroup.Add(1)
+		expanded[cmdIdx], cmdErrs = expandCommand(ctx, fmt.Sprintf("%s[%d]", taskName, cmdIdx), cmd, frame, strict)
 
-	tfiles.Dir = dir
+		for _, err := range cmdErrs {
+			errs = append(errs, fmt.Errorf("command %d: %w", cmdIdx, err))
+		}
+	}
 
-	go func() {
-		defer termWaitGroup.Done()
+	return expanded, errors.Join(errs...)
+}
 
-		<-termChannel
+// expandCommand returns a copy of a command, named scriptName, with its
+// words, pipe stages, file operation, download and parallel commands
+// expanded.
+func expandCommand(ctx context.Context, scriptName string, cmd tpkl.Command, frame *Frame, strict bool,
+) (expandedCommand, []error) {
+	var errs []error
 
-		_ = os.RemoveAll(tfiles.Dir)
-	}()
+	expanded := expandedCommand{Command: cmd}
 
-	for key, file := range files {
-		var filename string
+	expandString := func(input string) (string, error) {
+		return frame.Expand(input, strict)
+	}
 
-		if file.Filename != nil {
-			filename = *file.Filename
-		} else {
-			filename = key
-		}
+	words, environ, wordsErrs := expandCommandWords(ctx, scriptName, cmd, frame, strict)
+	errs = append(errs, wordsErrs...)
+	expanded.Cmd, expanded.environ = words, environ
 
-		path := filepath.Join(tfiles.Dir, filename)
+	stages, stagesErrs := expandPipeStages(cmd, frame, strict)
+	errs = append(errs, stagesErrs...)
+	expanded.Pipe = stages
 
-		tmpfile, err := os.Create(path) // #nosec G304
+	if cmd.File != nil {
+		file, err := expandFileOperation(*cmd.File, expandString)
 		if err != nil {
-			return &tfiles, fmt.Errorf("%w: creating temporary file: %q: %w", ErrTaskFile, path, err)
+			errs = append(errs, err)
 		}
 
-		tfiles.Files[key] = taskFile{Path: path, Varname: file.Varname}
+		expanded.File = file
+	}
 
-		_, err = tmpfile.WriteString(file.Content)
+	if cmd.Download != nil {
+		download, err := expandDownload(*cmd.Download, expandString)
 		if err != nil {
-			return &tfiles, fmt.Errorf("%w: writing to temporary file: %q: %w", ErrTaskFile, path, err)
+			errs = append(errs, err)
 		}
 
-		err = tmpfile.Close()
+		expanded.Download = download
+	}
+
+	if len(cmd.Parallel) > 0 {
+		parallel, err := expandCommands(ctx, scriptName, cmd.Parallel, frame, strict)
 		if err != nil {
-			return &tfiles, fmt.Errorf("%w: closing temporary file: %q: %w", ErrTaskFile, path, err)
+			errs = append(errs, err)
 		}
+
+		expanded.parallel = parallel
 	}
 
-	err = frame.setTaskFilesVars(&tfiles)
+	return expanded, errs
+}
+
+// expandCommandWords returns the expanded words of a command, and the
+// variables referenced by its shell script, if any.
+func expandCommandWords(ctx context.Context, scriptName string, cmd tpkl.Command, frame *Frame, strict bool,
+) ([]string, []string, []error) {
+	var (
+		errs    []error
+		environ []string
+	)
+
+	cmdWords, err := commandWords(cmd)
 	if err != nil {
-		return &tfiles, err
+		errs = append(errs, err)
 	}
 
-	return &tfiles, nil
-}
+	words := make([]string, 0, len(cmdWords))
 
-func (tf *taskFiles) cleanup() error {
-	if len(tf.Dir) == 0 {
-		return nil
+	scriptIdx := -1
+	if cmd.EmbeddedShell {
+		scriptIdx = 0
+	} else if cmd.ScriptIndex != nil {
+		scriptIdx = *cmd.ScriptIndex
 	}
 
-	err := os.RemoveAll(tf.Dir)
-	if err != nil {
-		return fmt.Errorf("%w: removing temporary directory: %s: %w", ErrTaskFile, tf.Dir, err)
+	for wordIdx, word := range cmdWords {
+		if wordIdx == scriptIdx {
+			script, err := expandScript(word, frame, strict)
+			if err != nil {
+				errs = append(errs, err)
+			}
+
+			script.lint(ctx, scriptName)
+
+			words = append(words, script.text)
+			environ = script.environ
+
+			continue
+		}
+
+		word, err := expandWord(word, frame, strict)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		words = append(words, word...)
 	}
 
-	return nil
+	if len(cmdWords) > 0 && len(words) == 0 {
+		errs = append(errs, fmt.Errorf("%w: no words once expanded", ErrEmptyCommand))
+	}
+
+	return words, environ, errs
 }
 
-// Set variables relative to task files in a frame.
-func (f *Frame) setTaskFilesVars(files *taskFiles) error {
-	var (
-		err                            error
-		fileIndex, enclosingFilesCount int
-	)
+// expandPipeStages returns the expanded words of the pipe stages of a
+// command.
+func expandPipeStages(cmd tpkl.Command, frame *Frame, strict bool) ([][]string, []error) {
+	var errs []error
+
+	stages, err := pipeWords(cmd)
+	if err != nil {
+		errs = append(errs, err)
+	}
 
-	// Get TPKL_FILES_COUNT from enclosing frame if any
-	if f.enclosing != nil {
-		enclosingVars := f.enclosing.Merge()
-		name := prefixedVarName(filesCountVarNameSuffix)
+	if len(stages) == 0 {
+		return cmd.Pipe, errs
+	}
 
-		if value, ok := enclosingVars[name]; ok {
-			enclosingFilesCount, err = strconv.Atoi(value)
-			if err == nil {
-				fileIndex = enclosingFilesCount
-			} else {
-				return fmt.Errorf("%w: converting environment variable `%s` value to integer: %w", ErrTaskFile, name, err)
+	expanded := make([][]string, len(stages))
+
+	for stageIdx, stage := range stages {
+		for _, word := range stage {
+			word, err := expandWord(word, frame, strict)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("stage %d: %w", stageIdx, err))
 			}
+
+			expanded[stageIdx] = append(expanded[stageIdx], word...)
+		}
+
+		if len(expanded[stageIdx]) == 0 {
+			errs = append(errs, fmt.Errorf("stage %d: %w: no words once expanded", stageIdx, ErrEmptyCommand))
 		}
 	}
 
-	// Set TPKL_FILES_COUNT for this frame.
-	f.setPrefixedVar(filesCountVarNameSuffix, strconv.Itoa(enclosingFilesCount+len(files.Files)))
+	return expanded, errs
+}
+
+// expandWord returns the expansion of a command word, a splat word expanding
+// into zero or more words.
+func expandWord(word string, frame *Frame, strict bool) ([]string, error) {
+	name, ok := varref.ParseSplat(word)
+	if !ok {
+		word, err := frame.Expand(word, strict)
 
-	if len(files.Dir) != 0 {
-		f.setPrefixedVar("FILES_DIR", files.Dir)
+		return []string{word}, err
 	}
 
-	for key, file := range files.Files {
-		f.setPrefixedVar("FILE_"+key, file.Path)
-		f.setPrefixedVar("FILES_KEY_"+strconv.Itoa(fileIndex), key)
-		f.setPrefixedVar("FILES_PATH_"+strconv.Itoa(fileIndex), file.Path)
+	splat, defined := frame.Splat(name)
 
-		if file.Varname != nil {
-			f.SetVar(*file.Varname, file.Path)
+	switch {
+	case defined:
+		return splat, nil
+	case strict:
+		return nil, fmt.Errorf("%w: `%s`", varref.ErrUndefined, name)
+	default:
+		return []string{word}, nil
+	}
+}
+
+// Prepend directories to the PATH variable of a frame, relative directories
+// being resolved against the directory of the tasks module.
+func (f *Frame) prependPath(dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+
+	merged := f.Merge()
+	moduleDir := f.moduleDir()
+	entries := make([]string, 0, len(dirs)+1)
+
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(moduleDir, dir)
 		}
 
-		fileIndex++
+		entries = append(entries, dir)
 	}
 
-	return nil
+	if pathEnv, ok := merged["PATH"]; ok && pathEnv != "" {
+		entries = append(entries, pathEnv)
+	}
+
+	f.SetVar("PATH", strings.Join(entries, string(filepath.ListSeparator)))
 }
 
-func expandTaskProperties(task tpkl.Task, mapping func(string) string) {
-	taskI, _ := task.(tpkl.TaskImpl)
+// Return the absolute path of the directory of the tasks module.
+func (f *Frame) moduleDir() string {
+	moduleDir := f.Merge()[prefixedVarName("MODULEDIR")]
 
-	for _, cmd := range taskI.Cmds {
-		for i, word := range cmd.Cmd {
-			cmd.Cmd[i] = expansion.Expand(word, mapping)
-		}
+	if absModuleDir, err := filepath.Abs(moduleDir); err == nil {
+		return absModuleDir
+	}
+
+	return moduleDir
+}
+
+// Set the task arguments variables of a frame.
+func (f *Frame) setTaskArgs(args []string) {
+	f.setPrefixedVar("TASK_ARGC", strconv.Itoa(len(args)))
+
+	for i, a := range args {
+		f.setPrefixedVar("TASK_ARG_"+strconv.Itoa(i), a)
 	}
 }
 
@@ -0,0 +1,145 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"mvdan.cc/sh/v3/interp"
+
+	"github.com/stoned/tpkl/internal/coreutils"
+	"github.com/stoned/tpkl/modules/tpkl"
+)
+
+// sandboxDevices are the devices embedded shell commands may always open for
+// writing.
+var sandboxDevices = []string{"/dev/null", "/dev/stdout", "/dev/stderr", "/dev/tty"} //nolint:gochecknoglobals
+
+// sandbox restricts the files embedded shell commands of a task may open for
+// writing, or write with builtin coreutils, to the ones under writableDirs,
+// and the external commands they may run to commands.
+type sandbox struct {
+	writableDirs []string
+	commands     []string
+	coreutils    bool
+}
+
+// newSandbox returns the sandbox of the embedded shell commands of a task,
+// or nil if the task is not sandboxed. The module directory and filesDirs,
+// the directories of the task files, are writable.
+func newSandbox(task tpkl.Task, moduleDir string, filesDirs []string) *sandbox {
+	if task.GetSandbox() == nil {
+		return nil
+	}
+
+	box := &sandbox{
+		writableDirs: append([]string{moduleDir}, filesDirs...),
+		commands:     task.GetSandbox().Commands,
+		coreutils:    task.GetBuiltinCoreutils(),
+	}
+
+	for _, path := range task.GetSandbox().WritablePaths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(moduleDir, path)
+		}
+
+		box.writableDirs = append(box.writableDirs, filepath.Clean(path))
+	}
+
+	return box
+}
+
+// runnerOptions returns the mvdan.cc shell interpreter options enforcing the
+// sandbox.
+func (box *sandbox) runnerOptions() []interp.RunnerOption {
+	return []interp.RunnerOption{
+		interp.OpenHandler(box.openHandler(interp.DefaultOpenHandler())),
+		interp.ExecHandlers(box.execHandler),
+	}
+}
+
+// openHandler returns an mvdan.cc shell interpreter open handler refusing
+// to open files for writing outside of the sandbox writable directories.
+func (box *sandbox) openHandler(next interp.OpenHandlerFunc) interp.OpenHandlerFunc {
+	return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+			err := box.checkWrite(interp.HandlerCtx(ctx).Dir, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return next(ctx, path, flag, perm)
+	}
+}
+
+// execHandler is an mvdan.cc shell interpreter exec handler middleware
+// refusing to run external commands, and the task call builtin, not allowed
+// by the sandbox, and builtin coreutils writing outside of the sandbox
+// writable directories.
+func (box *sandbox) execHandler(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(ctx context.Context, args []string) error {
+		if box.coreutils {
+			if handled, writes := coreutils.Handled(args); handled {
+				for _, path := range writes {
+					err := box.checkWrite(interp.HandlerCtx(ctx).Dir, path)
+					if err != nil {
+						return err
+					}
+				}
+
+				return next(ctx, args)
+			}
+		}
+
+		if !box.allowedCommand(interp.HandlerCtx(ctx).Dir, args[0]) {
+			return fmt.Errorf("%w: command not allowed: `%s`", ErrSandbox, args[0])
+		}
+
+		return next(ctx, args)
+	}
+}
+
+// checkWrite returns an error if path, relative to dir, is not a sandbox
+// device nor is under one of the sandbox writable directories.
+func (box *sandbox) checkWrite(dir string, path string) error {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	path = filepath.Clean(path)
+
+	if slices.Contains(sandboxDevices, path) {
+		return nil
+	}
+
+	for _, writableDir := range box.writableDirs {
+		rel, err := filepath.Rel(writableDir, path)
+		if err == nil && filepath.IsLocal(rel) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: writing outside of writable paths: `%s`", ErrSandbox, path)
+}
+
+// allowedCommand reports whether an external command is allowed, commands
+// names having to be allowed by name and commands paths, relative to dir,
+// by absolute path.
+func (box *sandbox) allowedCommand(dir string, name string) bool {
+	if !strings.ContainsRune(name, filepath.Separator) {
+		return slices.Contains(box.commands, name)
+	}
+
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+
+	return slices.ContainsFunc(box.commands, func(command string) bool {
+		return filepath.IsAbs(command) && filepath.Clean(command) == filepath.Clean(name)
+	})
+}
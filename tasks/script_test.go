@@ -11,19 +11,36 @@ import (
 // Generate testscript test scripts
 //go:generate go tool txtar -o testdata/script/calltask.txtar -c testdata/script/calltask/script -p 3 testdata/script/calltask/*.pkl testdata/script/calltask/*.txt
 //go:generate go tool txtar -o testdata/script/cmd.txtar -c testdata/script/cmd/script -p 3 testdata/script/cmd/*.pkl testdata/script/cmd/*.txt
+//go:generate go tool txtar -o testdata/script/coreutils.txtar -c testdata/script/coreutils/script -p 3 testdata/script/coreutils/*.pkl testdata/script/coreutils/*.txt
 //go:generate go tool txtar -o testdata/script/default-vars.txtar -c testdata/script/default-vars/script -p 3 testdata/script/default-vars/*.pkl testdata/script/default-vars/*.txt
+//go:generate go tool txtar -o testdata/script/download.txtar -c testdata/script/download/script -p 3 testdata/script/download/*.pkl testdata/script/download/*.txt
 //go:generate go tool txtar -o testdata/script/env.txtar -c testdata/script/env/script -p 3 testdata/script/env/*.pkl testdata/script/env/*.txt
 //go:generate go tool txtar -o testdata/script/env-var-flag.txtar -c testdata/script/env-var-flag/script -p 3 testdata/script/env-var-flag/*.pkl testdata/script/env-var-flag/*.txt
+//go:generate go tool txtar -o testdata/script/envfiles.txtar -c testdata/script/envfiles/script -p 3 testdata/script/envfiles/*.pkl testdata/script/envfiles/*.env testdata/script/envfiles/*.txt
+//go:generate go tool txtar -o testdata/script/envpassthrough.txtar -c testdata/script/envpassthrough/script -p 3 testdata/script/envpassthrough/*.pkl testdata/script/envpassthrough/*.txt
 //go:generate go tool txtar -o testdata/script/expand.txtar -c testdata/script/expand/script -p 3 testdata/script/expand/*.pkl testdata/script/expand/*.txt
+//go:generate go tool txtar -o testdata/script/fileops.txtar -c testdata/script/fileops/script -p 3 testdata/script/fileops/*.pkl testdata/script/fileops/*.txt
 //go:generate go tool txtar -o testdata/script/hidden-tasks.txtar -c testdata/script/hidden-tasks/script -p 3 testdata/script/hidden-tasks/*.pkl testdata/script/hidden-tasks/*.txt
 //go:generate go tool txtar -o testdata/script/inheritenv.txtar -c testdata/script/inheritenv/script -p 3 testdata/script/inheritenv/*.pkl testdata/script/inheritenv/*.txt
+//go:generate go tool txtar -o testdata/script/keepfiles.txtar -c testdata/script/keepfiles/script -p 3 testdata/script/keepfiles/*.pkl testdata/script/keepfiles/*.txt
 //go:generate go tool txtar -o testdata/script/mustsucceed.txtar -c testdata/script/mustsucceed/script -p 3 testdata/script/mustsucceed/*.pkl
 //go:generate go tool txtar -o testdata/script/nocmd.txtar -c testdata/script/nocmd/script -p 3 testdata/script/nocmd/*.pkl
+//go:generate go tool txtar -o testdata/script/parallel.txtar -c testdata/script/parallel/script -p 3 testdata/script/parallel/*.pkl testdata/script/parallel/*.txt
+//go:generate go tool txtar -o testdata/script/path.txtar -c testdata/script/path/script -p 3 testdata/script/path/*.pkl testdata/script/path/*.txt testdata/script/path/bin/*
+//go:generate go tool txtar -o testdata/script/pipe.txtar -c testdata/script/pipe/script -p 3 testdata/script/pipe/*.pkl testdata/script/pipe/*.txt
 //go:generate go tool txtar -o testdata/script/projectfile.txtar -c testdata/script/projectfile/script -p 3 testdata/script/projectfile/*.pkl
 //go:generate go tool txtar -o testdata/script/property-flag.txtar -c testdata/script/property-flag/script -p 3 testdata/script/property-flag/*.pkl
+//go:generate go tool txtar -o testdata/script/sandbox.txtar -c testdata/script/sandbox/script -p 3 testdata/script/sandbox/*.pkl testdata/script/sandbox/*.txt
+//go:generate go tool txtar -o testdata/script/secrets.txtar -c testdata/script/secrets/script -p 3 testdata/script/secrets/*.pkl testdata/script/secrets/*.txt
+//go:generate go tool txtar -o testdata/script/services.txtar -c testdata/script/services/script -p 3 testdata/script/services/*.pkl
 //go:generate go tool txtar -o testdata/script/sh.txtar -c testdata/script/sh/script -p 3 testdata/script/sh/*.pkl testdata/script/sh/*.txt
+//go:generate go tool txtar -o testdata/script/shellexpand.txtar -c testdata/script/shellexpand/script -p 3 testdata/script/shellexpand/*.pkl testdata/script/shellexpand/*.txt
+//go:generate go tool txtar -o testdata/script/shelloptions.txtar -c testdata/script/shelloptions/script -p 3 testdata/script/shelloptions/*.pkl testdata/script/shelloptions/*.txt
+//go:generate go tool txtar -o testdata/script/shellsession.txtar -c testdata/script/shellsession/script -p 3 testdata/script/shellsession/*.pkl testdata/script/shellsession/*.txt
+//go:generate go tool txtar -o testdata/script/shelltrace.txtar -c testdata/script/shelltrace/script -p 3 testdata/script/shelltrace/*.pkl testdata/script/shelltrace/*.txt
+//go:generate go tool txtar -o testdata/script/strictvars.txtar -c testdata/script/strictvars/script -p 3 testdata/script/strictvars/*.pkl testdata/script/strictvars/*.txt
 //go:generate go tool txtar -o testdata/script/task-args.txtar -c testdata/script/task-args/script -p 3 testdata/script/task-args/*.pkl testdata/script/task-args/*.txt
-//go:generate go tool txtar -o testdata/script/taskfiles.txtar -c testdata/script/taskfiles/script -p 3 testdata/script/taskfiles/*.pkl testdata/script/taskfiles/*.txt
+//go:generate go tool txtar -o testdata/script/taskfiles.txtar -c testdata/script/taskfiles/script -p 3 testdata/script/taskfiles/*.pkl testdata/script/taskfiles/*.txt testdata/script/taskfiles/src/*.txt testdata/script/taskfiles/src/sub/*.txt
 //go:generate go tool txtar -o testdata/script/taskscycle.txtar -c testdata/script/taskscycle/script -p 3 testdata/script/taskscycle/*.pkl testdata/script/taskscycle/*.txt
 //go:generate go tool txtar -o testdata/script/timeout-eval.txtar -c testdata/script/timeout-eval/script -p 3 testdata/script/timeout-eval/*.pkl
 //go:generate go tool txtar -o testdata/script/timeout.txtar -c testdata/script/timeout/script -p 3 testdata/script/timeout/*.pkl
@@ -31,7 +48,8 @@ import (
 
 func TestMain(m *testing.M) {
 	testscript.Main(m, map[string]func(){
-		"tpkl": cmd.Main,
+		"tpkl":       cmd.Main,
+		"tpkl-serve": testscriptcmds.Serve,
 	})
 }
 
@@ -39,7 +57,8 @@ func TestScript(t *testing.T) {
 	t.Parallel()
 
 	testscript.Run(t, testscript.Params{
-		Dir: "testdata/script",
+		Dir:   "testdata/script",
+		Setup: testscriptcmds.SetupPorts("TCP_PORT", "HTTP_PORT"),
 		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
 			"empty": testscriptcmds.Empty,
 		},
@@ -0,0 +1,433 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stoned/tpkl/log"
+	"github.com/stoned/tpkl/modules/tpkl"
+)
+
+// serviceSignals are the signals terminating services, by name.
+var serviceSignals = map[string]syscall.Signal{ //nolint:gochecknoglobals
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// service is a service of a task, running in the background.
+type service struct {
+	name    string
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+	outputs []*serviceOutput
+	logFile *os.File
+	// released is closed once the service is released.
+	released    chan struct{}
+	releaseOnce sync.Once
+}
+
+// startServices starts the services of a task, each one once the previous
+// one is ready. It returns the started services, to be stopped even if an
+// error is returned. They are also stopped upon termination signals.
+func startServices(ctx context.Context, services []tpkl.Service, frame *Frame, taskDir string, strict bool,
+	stdout, stderr io.Writer, termChannel chan any, termWaitGroup *sync.WaitGroup,
+) ([]*service, error) {
+	started := make([]*service, 0, len(services))
+
+	for _, definition := range services {
+		svc, err := startService(ctx, definition, frame, taskDir, strict, stdout, stderr, termChannel, termWaitGroup)
+		if svc != nil {
+			started = append(started, svc)
+		}
+
+		if err != nil {
+			return started, err
+		}
+	}
+
+	return started, nil
+}
+
+// startService starts a service, in its own process group, and waits for it
+// to be ready.
+func startService(ctx context.Context, definition tpkl.Service, frame *Frame, taskDir string, strict bool,
+	stdout, stderr io.Writer, termChannel chan any, termWaitGroup *sync.WaitGroup,
+) (*service, error) {
+	logger := log.FromContext(ctx).With().Str("service", definition.Name).Logger()
+
+	words := make([]string, 0, len(definition.Cmd))
+
+	for _, word := range definition.Cmd {
+		expanded, err := expandWord(word, frame, strict)
+		if err != nil {
+			return nil, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+		}
+
+		words = append(words, expanded...)
+	}
+
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%w: `%s`: no command", ErrService, definition.Name)
+	}
+
+	dir, err := commandWorkingDir(tpkl.Command{WorkingDir: definition.WorkingDir}, taskDir,
+		func(input string) (string, error) { return frame.Expand(input, strict) })
+	if err != nil {
+		return nil, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+	}
+
+	probe, err := newServiceProbe(definition.Ready, frame, dir, strict)
+	if err != nil {
+		return nil, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+	}
+
+	environ := frame.EnvList()
+
+	path, err := lookPath(words[0], environ)
+	if err != nil {
+		return nil, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+	}
+
+	svcCtx, cancel := context.WithCancel(ctx)
+
+	svc := &service{name: definition.Name, cancel: cancel, done: make(chan struct{}), released: make(chan struct{})}
+
+	svc.cmd = exec.CommandContext(svcCtx, path, words[1:]...)
+	svc.cmd.Args[0] = words[0]
+	svc.cmd.Dir = dir
+	svc.cmd.Env = environ
+	svc.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	svc.cmd.Cancel = func() error {
+		return signalGroup(svc.cmd.Process, serviceSignals[definition.StopSignal])
+	}
+	svc.cmd.WaitDelay = definition.GracePeriod.GoDuration()
+
+	if definition.LogFile != nil {
+		path := *definition.LogFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		svc.logFile, err = os.Create(path) //nolint:gosec
+		if err != nil {
+			cancel()
+
+			return nil, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+		}
+
+		stdout, stderr = svc.logFile, svc.logFile
+	}
+
+	prefix := "[" + definition.Name + "] "
+	if svc.logFile != nil {
+		prefix = ""
+	}
+
+	svc.outputs = []*serviceOutput{
+		{writer: stdout, prefix: prefix, probe: probe},
+		{writer: stderr, prefix: prefix, probe: probe},
+	}
+	svc.cmd.Stdout = svc.outputs[0]
+	svc.cmd.Stderr = svc.outputs[1]
+
+	logger.Info().Str("cmd", displayCommand(words)).Msg("starting service")
+	log.DebugCmd(ctx, words)
+
+	err = svc.cmd.Start()
+	if err != nil {
+		svc.release()
+
+		return nil, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+	}
+
+	go func() {
+		svc.err = svc.cmd.Wait()
+		close(svc.done)
+	}()
+
+	termWaitGroup.Add(1)
+
+	go func() {
+		defer termWaitGroup.Done()
+
+		select {
+		case <-termChannel:
+			svc.release()
+		case <-svc.released:
+		}
+	}()
+
+	err = probe.wait(ctx, svc, definition.StartupTimeout.GoDuration())
+	if err != nil {
+		return svc, fmt.Errorf("%w: `%s`: %w", ErrService, definition.Name, err)
+	}
+
+	logger.Info().Msg("service ready")
+
+	return svc, nil
+}
+
+// stopServices terminates services, in reverse order.
+func stopServices(ctx context.Context, services []*service) {
+	logger := log.FromContext(ctx)
+
+	for idx := len(services) - 1; idx >= 0; idx-- {
+		svc := services[idx]
+
+		select {
+		case <-svc.done:
+			logger.Warn().Str("service", svc.name).AnErr("error", svc.err).Msg("service exited before the task end")
+		default:
+			logger.Info().Str("service", svc.name).Msg("stopping service")
+		}
+
+		svc.release()
+	}
+}
+
+// release terminates a service, if still running, and releases its outputs.
+// Once its main process is done, the processes left in its process group are
+// killed.
+func (svc *service) release() {
+	svc.releaseOnce.Do(func() {
+		svc.cancel()
+
+		if svc.cmd.Process != nil {
+			<-svc.done
+
+			_ = signalGroup(svc.cmd.Process, syscall.SIGKILL)
+		}
+
+		for _, output := range svc.outputs {
+			output.flush()
+			flushOutputs(output.writer)
+		}
+
+		if svc.logFile != nil {
+			_ = svc.logFile.Close()
+		}
+
+		close(svc.released)
+	})
+}
+
+// signalGroup sends a signal to the process group led by process.
+func signalGroup(process *os.Process, signal syscall.Signal) error {
+	err := syscall.Kill(-process.Pid, signal)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+
+	return err //nolint:wrapcheck
+}
+
+// serviceOutput writes the output of a service, lines being prefixed and
+// checked by its log readiness probe, if any.
+type serviceOutput struct {
+	writer io.Writer
+	prefix string
+	probe  *serviceProbe
+	line   []byte
+}
+
+func (output *serviceOutput) Write(data []byte) (int, error) {
+	output.line = append(output.line, data...)
+
+	for {
+		idx := bytes.IndexByte(output.line, '\n')
+		if idx < 0 {
+			return len(data), nil
+		}
+
+		err := output.writeLine(output.line[:idx+1])
+
+		output.line = output.line[idx+1:]
+
+		if err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// flush writes the last line, if not terminated by a newline.
+func (output *serviceOutput) flush() {
+	if len(output.line) > 0 {
+		_ = output.writeLine(append(output.line, '\n'))
+		output.line = nil
+	}
+}
+
+func (output *serviceOutput) writeLine(line []byte) error {
+	output.probe.checkLine(line)
+
+	_, err := io.WriteString(output.writer, output.prefix+string(line))
+
+	return err //nolint:wrapcheck
+}
+
+// serviceProbe is the readiness probe of a service.
+type serviceProbe struct {
+	tcp      string
+	http     string
+	file     string
+	log      *regexp.Regexp
+	logged   chan struct{}
+	logOnce  sync.Once
+	interval time.Duration
+}
+
+// newServiceProbe returns the probe of a service, expanding its definition.
+// A service without probe is always ready.
+func newServiceProbe(definition *tpkl.Probe, frame *Frame, dir string, strict bool) (*serviceProbe, error) {
+	probe := &serviceProbe{}
+
+	if definition == nil {
+		return probe, nil
+	}
+
+	probe.interval = definition.Interval.GoDuration()
+
+	for _, field := range []struct {
+		value  *string
+		target *string
+	}{
+		{definition.Tcp, &probe.tcp},
+		{definition.Http, &probe.http},
+		{definition.File, &probe.file},
+	} {
+		if field.value == nil {
+			continue
+		}
+
+		value, err := frame.Expand(*field.value, strict)
+		if err != nil {
+			return nil, fmt.Errorf("readiness probe: %w", err)
+		}
+
+		*field.target = value
+	}
+
+	if probe.file != "" && !filepath.IsAbs(probe.file) {
+		probe.file = filepath.Join(dir, probe.file)
+	}
+
+	if definition.Log != nil {
+		pattern, err := frame.Expand(*definition.Log, strict)
+		if err != nil {
+			return nil, fmt.Errorf("readiness probe: %w", err)
+		}
+
+		probe.log, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("readiness probe: %w", err)
+		}
+
+		probe.logged = make(chan struct{})
+	}
+
+	return probe, nil
+}
+
+// checkLine checks a line of the service output with the log probe.
+func (probe *serviceProbe) checkLine(line []byte) {
+	if probe.log != nil && probe.log.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+		probe.logOnce.Do(func() { close(probe.logged) })
+	}
+}
+
+// wait waits for a service to be ready, returning an error if it exits or
+// is not ready before timeout.
+func (probe *serviceProbe) wait(ctx context.Context, svc *service, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(max(probe.interval, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		if probe.ready(ctx) {
+			return nil
+		}
+
+		select {
+		case <-svc.done:
+			if svc.err != nil {
+				return fmt.Errorf("%w: %w", ErrServiceExited, svc.err)
+			}
+
+			return ErrServiceExited
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s: %w", timeout, ctx.Err())
+		case <-probe.logged:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ready reports whether the probe succeeds.
+func (probe *serviceProbe) ready(ctx context.Context) bool {
+	switch {
+	case probe.tcp != "":
+		dialer := net.Dialer{Timeout: probe.interval}
+
+		conn, err := dialer.DialContext(ctx, "tcp", probe.tcp)
+		if err != nil {
+			return false
+		}
+
+		_ = conn.Close()
+
+		return true
+
+	case probe.http != "":
+		ctx, cancel := context.WithTimeout(ctx, max(probe.interval, time.Second))
+		defer cancel()
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.http, nil)
+		if err != nil {
+			return false
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return false
+		}
+
+		_ = response.Body.Close()
+
+		return response.StatusCode >= http.StatusOK && response.StatusCode < http.StatusMultipleChoices
+
+	case probe.file != "":
+		_, err := os.Stat(probe.file)
+
+		return err == nil
+
+	case probe.log != nil:
+		select {
+		case <-probe.logged:
+			return true
+		default:
+			return false
+		}
+
+	default:
+		return true
+	}
+}
@@ -0,0 +1,413 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+
+	"github.com/stoned/tpkl/internal/coreutils"
+	"github.com/stoned/tpkl/internal/expansion"
+	"github.com/stoned/tpkl/internal/varref"
+	"github.com/stoned/tpkl/log"
+	"github.com/stoned/tpkl/modules/tpkl"
+)
+
+// shellStrictOptions are the embedded shell options enabled by the shell
+// strict run option.
+var shellStrictOptions = []string{"errexit", "nounset", "pipefail"} //nolint:gochecknoglobals
+
+// taskCallBuiltin is the name of the embedded shell builtin calling tasks,
+// e.g. `tpkl-task deploy "$env"`.
+const taskCallBuiltin = "tpkl-task"
+
+// scriptVarNamePrefix is the prefix of the variables holding the values of
+// shell scripts variable references which are not plain frame variables.
+const scriptVarNamePrefix = "EXPANSION_"
+
+// expandedScript is a shell script whose variable references were replaced
+// by references to shell variables.
+type expandedScript struct {
+	text    string
+	environ []string
+	names   map[string]bool
+}
+
+// expandScript replaces the variable references of a shell script by
+// references to shell variables, so that their values are never parsed as
+// shell code. References to frame variables become references to the
+// environment variables of the same name, other references, like the ones
+// with operators, to additional environment variables.
+func expandScript(script string, frame *Frame, strict bool) (*expandedScript, error) {
+	var errs []error
+
+	expanded := &expandedScript{names: make(map[string]bool)}
+
+	expanded.text = expansion.Expand(script, func(content string) string {
+		ref, ok := varref.ParseReference(content)
+		if !ok {
+			return "$(" + content + ")"
+		}
+
+		value, defined, err := ref.Resolve(frame.Lookup)
+
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+
+			return "$(" + content + ")"
+		case !defined:
+			if strict {
+				errs = append(errs, fmt.Errorf("%w: `%s`", varref.ErrUndefined, ref.Name))
+			}
+
+			return "$(" + content + ")"
+		case ref.Operator == "" && syntax.ValidName(ref.Name):
+			expanded.names[ref.Name] = true
+
+			return "${" + ref.Name + "}"
+		}
+
+		name := prefixedVarName(scriptVarNamePrefix + strconv.Itoa(len(expanded.environ)))
+		expanded.environ = append(expanded.environ, name+"="+value)
+		expanded.names[name] = true
+
+		return "${" + name + "}"
+	})
+
+	return expanded, errors.Join(errs...)
+}
+
+// lint logs warnings about replaced variable references subject to field
+// splitting and globbing because they are not double quoted, or not expanded
+// because they are single quoted.
+func (s *expandedScript) lint(ctx context.Context, where string) {
+	if len(s.names) == 0 {
+		return
+	}
+
+	file, err := syntax.NewParser().Parse(strings.NewReader(s.text), where)
+	if err != nil {
+		return
+	}
+
+	logger := log.FromContext(ctx)
+
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.CallExpr:
+			for _, word := range node.Args {
+				for _, part := range word.Parts {
+					if param, ok := part.(*syntax.ParamExp); ok && s.names[param.Param.Value] {
+						logger.Warn().Str("cmd", where).Str("var", param.Param.Value).
+							Msg("unquoted variable reference in shell script")
+					}
+				}
+			}
+		case *syntax.SglQuoted:
+			for name := range s.names {
+				if strings.Contains(node.Value, "${"+name+"}") {
+					logger.Warn().Str("cmd", where).Str("var", name).
+						Msg("variable reference in single quotes of shell script is not expanded")
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// shellSession runs the consecutive embedded shell commands of a task with a
+// single shell interpreter, keeping its state between them.
+type shellSession struct {
+	runner *interp.Runner
+}
+
+// shellRunnerOptions returns the options of the mvdan.cc shell interpreters
+// of embedded shell commands of a task, filesDirs being the directories of
+// its files. The sandbox exec handler comes first, so that it also restricts
+// the task call builtin.
+func (run *taskRun) shellRunnerOptions(task tpkl.Task, frame *Frame, filesDirs []string) []interp.RunnerOption {
+	var options []interp.RunnerOption
+
+	if box := newSandbox(task, frame.moduleDir(), filesDirs); box != nil {
+		options = append(options, box.runnerOptions()...)
+	}
+
+	options = append(options, interp.ExecHandlers(run.taskCallHandler(frame)))
+
+	if run.options.traceShell {
+		options = append(options, interp.CallHandler(traceShellCall))
+	}
+
+	if task.GetBuiltinCoreutils() {
+		options = append(options, interp.ExecHandlers(coreutils.ExecHandler))
+	}
+
+	return options
+}
+
+// taskCallHandler returns an mvdan.cc shell interpreter exec handler
+// middleware running the task call builtin, which calls a task with
+// arguments, frame being the one of the calling task. Variables exported by
+// the shell are set for the called task, and its exit status is the one of
+// the builtin.
+func (run *taskRun) taskCallHandler(frame *Frame) func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			if args[0] != taskCallBuiltin {
+				return next(ctx, args)
+			}
+
+			hc := interp.HandlerCtx(ctx)
+
+			if len(args) < 2 { //nolint:mnd
+				_, _ = fmt.Fprintf(hc.Stderr, "%s: missing task name\n", taskCallBuiltin)
+
+				return interp.ExitStatus(1)
+			}
+
+			callFrame := NewEnclosedFrame(frame)
+			exportVars(hc.Env.Each, callFrame)
+			callFrame.setTaskArgs(args[2:])
+
+			logger := log.FromContext(ctx)
+			logger.Info().Str("call", args[1]).Send()
+
+			err := runTask(contextWithOutputs(ctx, hc.Stdout, hc.Stderr), args[1], run, callFrame)
+			if err == nil {
+				return nil
+			}
+
+			var cmdErr *CmdError
+			if errors.As(err, &cmdErr) {
+				return interp.ExitStatus(cmdErr.ExitCode) //nolint:gosec
+			}
+
+			_, _ = fmt.Fprintf(hc.Stderr, "%s: %v\n", taskCallBuiltin, err)
+
+			return interp.ExitStatus(1)
+		}
+	}
+}
+
+// shellTaskCalls returns the names of the tasks called with the task call
+// builtin by a shell script, when they are literal words.
+func shellTaskCalls(script string) []string {
+	var calls []string
+
+	file, err := syntax.NewParser().Parse(strings.NewReader(script), "")
+	if err != nil {
+		return nil
+	}
+
+	syntax.Walk(file, func(node syntax.Node) bool {
+		call, ok := node.(*syntax.CallExpr)
+		if !ok || len(call.Args) < 2 || call.Args[0].Lit() != taskCallBuiltin { //nolint:mnd
+			return true
+		}
+
+		if name, ok := literalWord(call.Args[1]); ok {
+			calls = append(calls, name)
+		}
+
+		return true
+	})
+
+	return calls
+}
+
+// literalWord returns the value of a shell word made of literal, possibly
+// quoted, parts.
+func literalWord(word *syntax.Word) (string, bool) {
+	var value strings.Builder
+
+	for _, part := range word.Parts {
+		switch part := part.(type) {
+		case *syntax.Lit:
+			value.WriteString(part.Value)
+		case *syntax.SglQuoted:
+			value.WriteString(part.Value)
+		case *syntax.DblQuoted:
+			for _, quoted := range part.Parts {
+				lit, ok := quoted.(*syntax.Lit)
+				if !ok {
+					return "", false
+				}
+
+				value.WriteString(lit.Value)
+			}
+		default:
+			return "", false
+		}
+	}
+
+	return value.String(), true
+}
+
+// traceShellCall is an mvdan.cc shell interpreter call handler logging
+// simple commands, after expansion, with the logger of the context.
+func traceShellCall(ctx context.Context, args []string) ([]string, error) {
+	words := make([]string, len(args))
+
+	for idx, arg := range args {
+		quoted, err := syntax.Quote(arg, syntax.LangBash)
+		if err != nil {
+			quoted = strconv.Quote(arg)
+		}
+
+		words[idx] = quoted
+	}
+
+	log.TraceShell(ctx, interp.HandlerCtx(ctx).Pos.Line(), strings.Join(words, " "))
+
+	return args, nil
+}
+
+// run runs an embedded shell command in the session, starting the session
+// interpreter in dir on its first command. The working directory of
+// following commands is the one left by the previous command, unless chdir
+// is true, and so are the shell options not set by options. environ is the
+// environment of the session interpreter and extra environment variables are
+// exported before running the command. runnerOptions are the options of the
+// session interpreter.
+func (s *shellSession) run(ctx context.Context, scriptName string, command []string, options map[string]bool,
+	dir string, chdir bool, environ []string, extra []string, stdout, stderr io.Writer,
+	runnerOptions ...interp.RunnerOption,
+) error {
+	params := shellParams(options, command[1:])
+
+	if s.runner == nil {
+		runner, err := newShellRunner(params, dir, append(slices.Clip(environ), extra...), stdout, stderr,
+			runnerOptions...)
+		if err != nil {
+			return NewCmdError(1, err)
+		}
+
+		s.runner = runner
+
+		return runShellScript(ctx, runner, scriptName, command[0])
+	}
+
+	err := interp.StdIO(os.Stdin, stdout, stderr)(s.runner)
+	if err != nil {
+		return NewCmdError(1, err)
+	}
+
+	if chdir {
+		err = interp.Dir(dir)(s.runner)
+		if err != nil {
+			return NewCmdError(1, err)
+		}
+	}
+
+	err = interp.Params(params...)(s.runner)
+	if err != nil {
+		return NewCmdError(1, err)
+	}
+
+	if len(extra) > 0 {
+		err = s.runner.Run(ctx, exportStmt(extra))
+		if err != nil {
+			return NewCmdError(1, err)
+		}
+	}
+
+	return runShellScript(ctx, s.runner, scriptName, command[0])
+}
+
+// export sets in frame the variables exported by the session whose values
+// differ from the frame ones, so that they are in the environment of
+// following commands and called tasks.
+func (s *shellSession) export(frame *Frame) {
+	if s.runner == nil {
+		return
+	}
+
+	exportVars(maps.All(s.runner.Vars), frame)
+}
+
+// exportVars sets in frame the variables exported by a shell whose values
+// differ from the frame ones. Working directory variables and the ones
+// holding values of variable references are not set.
+func exportVars(vars iter.Seq2[string, expand.Variable], frame *Frame) {
+	for name, variable := range vars {
+		if !variable.Exported || !variable.IsSet() || variable.Kind != expand.String {
+			continue
+		}
+
+		if name == "PWD" || name == "OLDPWD" || strings.HasPrefix(name, prefixedVarName(scriptVarNamePrefix)) {
+			continue
+		}
+
+		if value, ok := frame.Lookup(name); ok && value == variable.Str {
+			continue
+		}
+
+		frame.SetVar(name, variable.Str)
+	}
+}
+
+// exportStmt returns an `export` statement of environment variables, their
+// values being single quoted words so that they are never parsed as shell
+// code.
+func exportStmt(environ []string) *syntax.Stmt {
+	decl := &syntax.DeclClause{Variant: &syntax.Lit{Value: "export"}}
+
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		decl.Args = append(decl.Args, &syntax.Assign{
+			Name:  &syntax.Lit{Value: name},
+			Value: &syntax.Word{Parts: []syntax.WordPart{&syntax.SglQuoted{Value: value}}},
+		})
+	}
+
+	return &syntax.Stmt{Cmd: decl}
+}
+
+// shellOptions returns the options of an embedded shell command, the ones of
+// the command overriding the ones of its task. The shell strict options are
+// enabled when strict is true, whatever the command and the task ones.
+func shellOptions(taskOptions map[string]bool, cmdOptions map[string]bool, strict bool) map[string]bool {
+	options := make(map[string]bool, len(taskOptions)+len(cmdOptions))
+
+	maps.Copy(options, taskOptions)
+	maps.Copy(options, cmdOptions)
+
+	if strict {
+		for _, name := range shellStrictOptions {
+			options[name] = true
+		}
+	}
+
+	return options
+}
+
+// shellParams returns the parameters of an mvdan.cc shell interpreter
+// setting shell options, like `set -o`/`set +o` do, and positional
+// parameters.
+func shellParams(options map[string]bool, args []string) []string {
+	params := make([]string, 0, 2*len(options)+1+len(args)) //nolint:mnd
+
+	for _, name := range slices.Sorted(maps.Keys(options)) {
+		if options[name] {
+			params = append(params, "-o", name)
+		} else {
+			params = append(params, "+o", name)
+		}
+	}
+
+	params = append(params, "--")
+
+	return append(params, args...)
+}
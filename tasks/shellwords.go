@@ -0,0 +1,233 @@
+package tasks
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+
+	"github.com/stoned/tpkl/internal/varref"
+	"github.com/stoned/tpkl/modules/tpkl"
+)
+
+// commandWords returns the words of a command, the single word of commands
+// flagged with shellWords being split into words.
+func commandWords(cmd tpkl.Command) ([]string, error) {
+	if !cmd.ShellWords || len(cmd.Cmd) != 1 {
+		return cmd.Cmd, nil
+	}
+
+	return splitShellWords(cmd.Cmd[0])
+}
+
+// pipeWords returns the words of the stages of a pipeline, the single word
+// of stages of commands flagged with shellWords being split into words.
+func pipeWords(cmd tpkl.Command) ([][]string, error) {
+	if !cmd.ShellWords {
+		return cmd.Pipe, nil
+	}
+
+	stages := make([][]string, len(cmd.Pipe))
+
+	for stageIdx, stage := range cmd.Pipe {
+		if len(stage) != 1 {
+			stages[stageIdx] = stage
+
+			continue
+		}
+
+		words, err := splitShellWords(stage[0])
+		if err != nil {
+			return nil, fmt.Errorf("stage %d: %w", stageIdx, err)
+		}
+
+		stages[stageIdx] = words
+	}
+
+	return stages, nil
+}
+
+// splitShellWords splits a string into words following the POSIX shell rules
+// of quotes and backslash escapes, without expansions nor globbing. Variable
+// references, e.g. `$(VAR)`, and escaped ones, e.g. `$$(VAR)`, are kept to be
+// expanded with the words.
+func splitShellWords(input string) ([]string, error) {
+	input, escaped := protectEscapedReferences(input)
+
+	file, err := syntax.NewParser().Parse(strings.NewReader(input), "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrShellWords, err)
+	}
+
+	if len(file.Stmts) != 1 {
+		return nil, fmt.Errorf("%w: not a single command: `%s`", ErrShellWords, input)
+	}
+
+	stmt := file.Stmts[0]
+
+	call, ok := stmt.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Assigns) != 0 || len(stmt.Redirs) != 0 || stmt.Negated || stmt.Background {
+		return nil, fmt.Errorf("%w: not a simple command: `%s`", ErrShellWords, input)
+	}
+
+	config := &expand.Config{
+		CmdSubst: func(writer io.Writer, cmdSubst *syntax.CmdSubst) error {
+			reference := input[cmdSubst.Pos().Offset():cmdSubst.End().Offset()]
+			if !isReference(reference) {
+				return fmt.Errorf("%w: command substitution: `%s`", ErrShellWords, reference)
+			}
+
+			_, err := io.WriteString(writer, reference)
+
+			return err
+		},
+	}
+
+	words := make([]string, 0, len(call.Args))
+
+	for _, word := range call.Args {
+		var text strings.Builder
+
+		for _, part := range word.Parts {
+			switch part := part.(type) {
+			case *syntax.Lit:
+				text.WriteString(unescapeLit(part.Value))
+			case *syntax.SglQuoted, *syntax.DblQuoted, *syntax.CmdSubst:
+				err = checkShellWordPart(input, part)
+				if err != nil {
+					return nil, err
+				}
+
+				value, err := expand.Literal(config, &syntax.Word{Parts: []syntax.WordPart{part}})
+				if err != nil {
+					return nil, err //nolint:wrapcheck
+				}
+
+				text.WriteString(value)
+			default:
+				return nil, fmt.Errorf("%w: expansion: `%s`", ErrShellWords, input[part.Pos().Offset():part.End().Offset()])
+			}
+		}
+
+		words = append(words, restoreEscapedReferences(text.String(), escaped))
+	}
+
+	return words, nil
+}
+
+// escapedReferenceStart and escapedReferenceEnd delimit the placeholders of escaped variable
+// references, private use characters being literal for the shell parser.
+const (
+	escapedReferenceStart = "\uE000"
+	escapedReferenceEnd   = "\uE001"
+)
+
+// protectEscapedReferences replaces the escaped variable references of a
+// string, e.g. `$$(VAR)`, which are not valid shell words, by placeholders.
+// It returns the string and the replaced references.
+func protectEscapedReferences(input string) (string, []string) {
+	var (
+		output  strings.Builder
+		escaped []string
+	)
+
+	for {
+		start := strings.Index(input, "$$(")
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexByte(input[start:], ')')
+		if end < 0 {
+			break
+		}
+
+		end += start + 1
+
+		output.WriteString(input[:start])
+		output.WriteString(escapedReferenceStart + strconv.Itoa(len(escaped)) + escapedReferenceEnd)
+		escaped = append(escaped, input[start:end])
+		input = input[end:]
+	}
+
+	output.WriteString(input)
+
+	return output.String(), escaped
+}
+
+// restoreEscapedReferences replaces the placeholders of a word by the
+// escaped variable references they replaced.
+func restoreEscapedReferences(word string, escaped []string) string {
+	for idx, reference := range escaped {
+		word = strings.ReplaceAll(word, escapedReferenceStart+strconv.Itoa(idx)+escapedReferenceEnd, reference)
+	}
+
+	return word
+}
+
+// checkShellWordPart returns an error if a quoted word part contains a shell
+// expansion other than a variable reference.
+func checkShellWordPart(input string, part syntax.WordPart) error {
+	var err error
+
+	syntax.Walk(part, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.CmdSubst:
+			return false
+		case *syntax.ParamExp, *syntax.ArithmExp, *syntax.ProcSubst:
+			err = fmt.Errorf("%w: expansion: `%s`", ErrShellWords, input[node.Pos().Offset():node.End().Offset()])
+		}
+
+		return err == nil
+	})
+
+	return err
+}
+
+// isReference reports whether text is a variable reference or a splat word.
+func isReference(text string) bool {
+	if _, ok := varref.ParseSplat(text); ok {
+		return true
+	}
+
+	content, ok := strings.CutPrefix(text, "$(")
+	if !ok {
+		return false
+	}
+
+	content, ok = strings.CutSuffix(content, ")")
+	if !ok {
+		return false
+	}
+
+	_, ok = varref.ParseReference(content)
+
+	return ok
+}
+
+// unescapeLit removes the backslashes of an unquoted shell literal, escaped
+// newlines being removed too.
+func unescapeLit(value string) string {
+	if !strings.ContainsRune(value, '\\') {
+		return value
+	}
+
+	var text strings.Builder
+
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] == '\\' && idx+1 < len(value) {
+			idx++
+
+			if value[idx] == '\n' {
+				continue
+			}
+		}
+
+		text.WriteByte(value[idx])
+	}
+
+	return text.String()
+}
@@ -29,13 +29,43 @@ const identifierPrefix = "TPKL_"
 // the number of files defined by the currently executing Task.
 const filesCountVarNameSuffix = "FILES_COUNT"
 
+// filesDirVarNameSuffix is the suffix for the environment variable holding
+// the directory of the task scoped files of the currently executing Task.
+const filesDirVarNameSuffix = "FILES_DIR"
+
+// runFilesDirVarNameSuffix is the suffix for the environment variable holding
+// the directory of the run scoped files of the currently executing Task.
+const runFilesDirVarNameSuffix = "RUN_FILES_DIR"
+
+// Policies keeping task files directories instead of removing them.
+const (
+	// KeepFilesNever always removes task files.
+	KeepFilesNever = "never"
+	// KeepFilesOnFailure keeps task files of failed tasks.
+	KeepFilesOnFailure = "on-failure"
+	// KeepFilesAlways always keeps task files.
+	KeepFilesAlways = "always"
+)
+
 // moduleFilename is the default Pkl module filename in which tasks
 // are searched for.
 const moduleFilename = "tasks.pkl"
 
 var (
+	// ErrDownload signals a failed download.
+	ErrDownload = errors.New("download failure")
+	// ErrEmptyCommand signals a command or a pipe stage without words once expanded.
+	ErrEmptyCommand = errors.New("empty command")
+	// ErrEnvFile signals an error with a task environment file.
+	ErrEnvFile = errors.New("error with environment file")
+	// ErrEnvPattern signals an invalid environment variable name pattern.
+	ErrEnvPattern = errors.New("invalid environment variable pattern")
 	// ErrEvaluateExpr signals an error while evaluating the Pkl module.
 	ErrEvaluateExpr = errors.New("error evaluating expression in module")
+	// ErrFileOperation signals a failed file operation command.
+	ErrFileOperation = errors.New("file operation failure")
+	// ErrInvalidOption signals an invalid option value.
+	ErrInvalidOption = errors.New("invalid option")
 	// ErrIO signals an I/O error.
 	ErrIO = errors.New("I/O error")
 	// ErrJSONMarshal signals an error marshaling as JSON.
@@ -48,6 +78,14 @@ var (
 	ErrNoModule = errors.New("no module")
 	// ErrNoProject signals an error searching for a PklProject file.
 	ErrNoProject = errors.New("error searching for PklProject")
+	// ErrSandbox signals an embedded shell command violating its task sandbox.
+	ErrSandbox = errors.New("sandbox violation")
+	// ErrService signals a task service failing to start.
+	ErrService = errors.New("service failure")
+	// ErrServiceExited signals a task service exiting before being ready.
+	ErrServiceExited = errors.New("exited before being ready")
+	// ErrShellWords signals a command string which can't be split into shell words.
+	ErrShellWords = errors.New("invalid shell words")
 	// ErrTaskCycle signals a call cycle between tasks.
 	ErrTaskCycle = errors.New("tasks cycle")
 	// ErrTaskFile signals an error with a task file.
@@ -58,6 +96,8 @@ var (
 	ErrUnknownTask = errors.New("unknown task")
 	// ErrUnknownOption signals an unknown option.
 	ErrUnknownOption = errors.New("unknown option")
+	// ErrVarCycle signals variables referencing each other.
+	ErrVarCycle = errors.New("variables reference cycle")
 )
 
 // Tasks is a mapping from string to tpkl.Task.
@@ -149,6 +189,33 @@ type envOption struct {
 	env []string
 }
 
+// WithEnvReport initializes a struct to define an "env report option".
+func WithEnvReport(envReport bool) *envReportOption {
+	return &envReportOption{envReport}
+}
+
+type envReportOption struct {
+	envReport bool
+}
+
+// WithKeepFiles initializes a struct to define a "keep files option".
+func WithKeepFiles(keepFiles string) *keepFilesOption {
+	return &keepFilesOption{keepFiles}
+}
+
+type keepFilesOption struct {
+	keepFiles string
+}
+
+// WithMaskOutput initializes a struct to define a "mask output option".
+func WithMaskOutput(maskOutput bool) *maskOutputOption {
+	return &maskOutputOption{maskOutput}
+}
+
+type maskOutputOption struct {
+	maskOutput bool
+}
+
 // WithModule initializes a struct to define a "module option".
 func WithModule(module string) *moduleOption {
 	return &moduleOption{module}
@@ -167,6 +234,24 @@ type propertiesOption struct {
 	properties []string
 }
 
+// WithShellStrict initializes a struct to define a "shell strict option".
+func WithShellStrict(shellStrict bool) *shellStrictOption {
+	return &shellStrictOption{shellStrict}
+}
+
+type shellStrictOption struct {
+	shellStrict bool
+}
+
+// WithStrictVars initializes a struct to define a "strict variables option".
+func WithStrictVars(strictVars bool) *strictVarsOption {
+	return &strictVarsOption{strictVars}
+}
+
+type strictVarsOption struct {
+	strictVars bool
+}
+
 // WithTimeout initializes a struct to define a "timeout option".
 func WithTimeout(timeout *time.Duration) *timeoutOption {
 	return &timeoutOption{timeout}
@@ -176,6 +261,15 @@ type timeoutOption struct {
 	timeout *time.Duration
 }
 
+// WithTraceShell initializes a struct to define a "trace shell option".
+func WithTraceShell(traceShell bool) *traceShellOption {
+	return &traceShellOption{traceShell}
+}
+
+type traceShellOption struct {
+	traceShell bool
+}
+
 // WithVerbosity initializes a struct to define a "verbosity option".
 func WithVerbosity(verbose int) *verbosityOption {
 	return &verbosityOption{verbose}